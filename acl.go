@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	aclXattrAccess  string = "system.posix_acl_access"
+	aclXattrDefault string = "system.posix_acl_default"
+
+	// The version of the xattr format of POSIX ACLs on Linux
+	aclVersion uint32 = 2
+	// The id of entries without qualifier
+	aclUndefinedID uint32 = 0xffffffff
+	aclHeaderSize         = 4
+	aclEntrySize          = 8
+)
+
+const (
+	aclTagUserObj  uint16 = 0x01
+	aclTagUser     uint16 = 0x02
+	aclTagGroupObj uint16 = 0x04
+	aclTagGroup    uint16 = 0x08
+	aclTagMask     uint16 = 0x10
+	aclTagOther    uint16 = 0x20
+)
+
+// aclEntry is an entry of POSIX ACL in the xattr format
+type aclEntry struct {
+	Tag  uint16
+	Perm uint16
+	ID   uint32
+}
+
+// aclRule is a parsed entry of setfacl(1) style ACL expression
+type aclRule struct {
+	Tag uint16
+	// The uid or gid for the named user or group entries, aclUndefinedID for the others
+	ID   uint32
+	Perm uint16
+	// Add execute permission only if the file is a directory or already executable by someone, like the X of chmod(1)
+	ConditionalExec bool
+}
+
+// aclSpec is a parsed setfacl(1) style ACL expression, such as u:2000:rwX,g:3000:rX
+type aclSpec []aclRule
+
+// parseACL parses setfacl(1) style ACL expression of comma separated entries in TAG:[ID]:PERMS format. The TAG can
+// be u[ser], g[roup], m[ask] or o[ther], the ID needs to be a numeric uid or gid, and the PERMS are made of rwxX or -.
+// An empty ID of user or group means the owner or the owning group of the file.
+func parseACL(expr string) (aclSpec, error) {
+	var spec aclSpec
+	for _, entryExpr := range strings.Split(expr, ",") {
+		entryExpr = strings.TrimSpace(entryExpr)
+		if entryExpr == "" {
+			continue
+		}
+		parts := strings.Split(entryExpr, ":")
+		if len(parts) != 3 && len(parts) != 2 {
+			return nil, fmt.Errorf("Expected TAG:[ID]:PERMS in ACL entry %q", entryExpr)
+		}
+		tag, qualifier, perms := parts[0], "", parts[len(parts)-1]
+		if len(parts) == 3 {
+			qualifier = parts[1]
+		}
+		rule := aclRule{ID: aclUndefinedID}
+		switch tag {
+		case "u", "user":
+			rule.Tag = aclTagUserObj
+			if qualifier != "" {
+				rule.Tag = aclTagUser
+			}
+		case "g", "group":
+			rule.Tag = aclTagGroupObj
+			if qualifier != "" {
+				rule.Tag = aclTagGroup
+			}
+		case "m", "mask":
+			rule.Tag = aclTagMask
+		case "o", "other":
+			rule.Tag = aclTagOther
+		default:
+			return nil, fmt.Errorf("Invalid tag %q in ACL entry %q", tag, entryExpr)
+		}
+		if len(parts) == 2 && (rule.Tag == aclTagUserObj || rule.Tag == aclTagGroupObj) {
+			return nil, fmt.Errorf("Expected TAG:[ID]:PERMS in ACL entry %q", entryExpr)
+		}
+		if qualifier != "" {
+			if rule.Tag != aclTagUser && rule.Tag != aclTagGroup {
+				return nil, fmt.Errorf("Unexpected id %q in ACL entry %q", qualifier, entryExpr)
+			}
+			id, err := strconv.ParseUint(qualifier, 10, 32)
+			if err != nil || uint32(id) == aclUndefinedID {
+				return nil, fmt.Errorf("Invalid id %q in ACL entry %q, only numeric ids are supported", qualifier, entryExpr)
+			}
+			rule.ID = uint32(id)
+		}
+		if perms == "" {
+			return nil, fmt.Errorf("Missing permissions in ACL entry %q", entryExpr)
+		}
+		for _, perm := range perms {
+			switch perm {
+			case 'r':
+				rule.Perm |= 0o4
+			case 'w':
+				rule.Perm |= 0o2
+			case 'x':
+				rule.Perm |= 0o1
+			case 'X':
+				rule.ConditionalExec = true
+			case '-':
+			default:
+				return nil, fmt.Errorf("Invalid permission %q in ACL entry %q", perm, entryExpr)
+			}
+		}
+		spec = append(spec, rule)
+	}
+	if len(spec) == 0 {
+		return nil, fmt.Errorf("Empty ACL")
+	}
+	return spec, nil
+}
+
+// mapIDs maps the uids and gids of the named entries inside the container to the ones on the host
+func (spec aclSpec) mapIDs(container Container) (aclSpec, error) {
+	mapped := make(aclSpec, len(spec))
+	for index, rule := range spec {
+		if rule.Tag == aclTagUser || rule.Tag == aclTagGroup {
+			uid, gid := -1, -1
+			if rule.Tag == aclTagUser {
+				uid = int(rule.ID)
+			} else {
+				gid = int(rule.ID)
+			}
+			hostUID, hostGID, err := container.mapOwner(uid, gid)
+			if err != nil {
+				return nil, err
+			}
+			if rule.Tag == aclTagUser {
+				rule.ID = uint32(hostUID)
+			} else {
+				rule.ID = uint32(hostGID)
+			}
+		}
+		mapped[index] = rule
+	}
+	return mapped, nil
+}
+
+// apply merges the rules into the ACL entries like `setfacl -m` does, and returns the result. The mask is recalculated
+// as the union of the group class permissions unless it's provided explicitly.
+func (spec aclSpec) apply(entries []aclEntry, mode os.FileMode, isDir bool) []aclEntry {
+	result := append([]aclEntry{}, entries...)
+	explicitMask := false
+	for _, rule := range spec {
+		perm := rule.Perm
+		if rule.ConditionalExec && (isDir || mode&0o111 != 0) {
+			perm |= 0o1
+		}
+		if rule.Tag == aclTagMask {
+			explicitMask = true
+		}
+		found := false
+		for index, entry := range result {
+			if entry.Tag == rule.Tag && entry.ID == rule.ID {
+				result[index].Perm = perm
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, aclEntry{Tag: rule.Tag, Perm: perm, ID: rule.ID})
+		}
+	}
+	var groupClass uint16
+	needMask := false
+	maskIndex := -1
+	for index, entry := range result {
+		switch entry.Tag {
+		case aclTagUser, aclTagGroup:
+			needMask = true
+			groupClass |= entry.Perm
+		case aclTagGroupObj:
+			groupClass |= entry.Perm
+		case aclTagMask:
+			maskIndex = index
+		}
+	}
+	if !explicitMask && (needMask || maskIndex >= 0) {
+		if maskIndex >= 0 {
+			result[maskIndex].Perm = groupClass
+		} else {
+			result = append(result, aclEntry{Tag: aclTagMask, Perm: groupClass, ID: aclUndefinedID})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Tag != result[j].Tag {
+			return result[i].Tag < result[j].Tag
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// aclFromMode returns the minimal ACL entries equivalent to the permission bits of the mode
+func aclFromMode(mode os.FileMode) []aclEntry {
+	return []aclEntry{
+		{Tag: aclTagUserObj, Perm: uint16(mode>>6) & 0o7, ID: aclUndefinedID},
+		{Tag: aclTagGroupObj, Perm: uint16(mode>>3) & 0o7, ID: aclUndefinedID},
+		{Tag: aclTagOther, Perm: uint16(mode) & 0o7, ID: aclUndefinedID},
+	}
+}
+
+// encodeACL encodes the ACL entries into the xattr format
+func encodeACL(entries []aclEntry) []byte {
+	data := make([]byte, aclHeaderSize+aclEntrySize*len(entries))
+	binary.LittleEndian.PutUint32(data, aclVersion)
+	for index, entry := range entries {
+		offset := aclHeaderSize + aclEntrySize*index
+		binary.LittleEndian.PutUint16(data[offset:], entry.Tag)
+		binary.LittleEndian.PutUint16(data[offset+2:], entry.Perm)
+		binary.LittleEndian.PutUint32(data[offset+4:], entry.ID)
+	}
+	return data
+}
+
+// decodeACL decodes the ACL entries from the xattr format
+func decodeACL(data []byte) ([]aclEntry, error) {
+	if len(data) < aclHeaderSize || (len(data)-aclHeaderSize)%aclEntrySize != 0 {
+		return nil, fmt.Errorf("Invalid ACL xattr size %d", len(data))
+	}
+	version := binary.LittleEndian.Uint32(data)
+	if version != aclVersion {
+		return nil, fmt.Errorf("Unsupported ACL xattr version %d", version)
+	}
+	var entries []aclEntry
+	for offset := aclHeaderSize; offset < len(data); offset += aclEntrySize {
+		entries = append(entries, aclEntry{
+			Tag:  binary.LittleEndian.Uint16(data[offset:]),
+			Perm: binary.LittleEndian.Uint16(data[offset+2:]),
+			ID:   binary.LittleEndian.Uint32(data[offset+4:]),
+		})
+	}
+	return entries, nil
+}
+
+// getACL reads the ACL xattr of the file opened as O_PATH, it returns nil if there's no such ACL
+func getACL(target *os.File, name string) ([]aclEntry, error) {
+	for {
+		size, err := unix.Getxattr(fdPath(target), name, nil)
+		if errors.Is(err, unix.ENODATA) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: target.Name(), Err: err}
+		}
+		data := make([]byte, size)
+		size, err = unix.Getxattr(fdPath(target), name, data)
+		// The xattr could grow in the meantime
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: target.Name(), Err: err}
+		}
+		return decodeACL(data[:size])
+	}
+}
+
+// diffACL merges the access and default ACL specs into the existing ACLs of the file opened as O_PATH like setACL
+// does without writing them, and returns the resulting xattr values, nil for the ones unchanged or skipped
+func diffACL(target *os.File, file os.FileInfo, access aclSpec, defaults aclSpec) ([]byte, []byte, error) {
+	mode := file.Mode()
+	accessEntries, err := getACL(target, aclXattrAccess)
+	if err != nil {
+		return nil, nil, err
+	}
+	if accessEntries == nil {
+		accessEntries = aclFromMode(mode)
+	}
+	var accessData, defaultData []byte
+	if access != nil {
+		original := encodeACL(accessEntries)
+		accessEntries = access.apply(accessEntries, mode, file.IsDir())
+		data := encodeACL(accessEntries)
+		if string(data) != string(original) {
+			accessData = data
+		}
+	}
+	if defaults != nil && file.IsDir() {
+		defaultEntries, err := getACL(target, aclXattrDefault)
+		if err != nil {
+			return nil, nil, err
+		}
+		var original []byte
+		if defaultEntries == nil {
+			defaultEntries = accessEntries
+		} else {
+			original = encodeACL(defaultEntries)
+		}
+		data := encodeACL(defaults.apply(defaultEntries, mode, true))
+		if string(data) != string(original) {
+			defaultData = data
+		}
+	}
+	return accessData, defaultData, nil
+}
+
+// setACL merges the access and default ACL specs into the existing ACLs of the file opened as O_PATH, a nil spec is
+// skipped. The default ACL is only set for directories, it's based on the access ACL if there's none yet, like what
+// setfacl(1) does. It returns true if any of the ACLs is changed.
+func setACL(target *os.File, file os.FileInfo, access aclSpec, defaults aclSpec) (bool, error) {
+	accessData, defaultData, err := diffACL(target, file, access, defaults)
+	if err != nil {
+		return false, err
+	}
+	if accessData != nil {
+		err = setXattr(target, aclXattrAccess, accessData)
+		if err != nil {
+			return false, err
+		}
+	}
+	if defaultData != nil {
+		err = setXattr(target, aclXattrDefault, defaultData)
+		if err != nil {
+			return false, err
+		}
+	}
+	return accessData != nil || defaultData != nil, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func Test_parseACL(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    string
+		want    aclSpec
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{
+			"named",
+			"u:2000:rwX,g:3000:rX",
+			aclSpec{
+				{Tag: aclTagUser, ID: 2000, Perm: 0o6, ConditionalExec: true},
+				{Tag: aclTagGroup, ID: 3000, Perm: 0o4, ConditionalExec: true},
+			},
+			assert.NoError,
+		},
+		{
+			"long-tags",
+			"user::rwx,group::r-x,mask::rx,other::-",
+			aclSpec{
+				{Tag: aclTagUserObj, ID: aclUndefinedID, Perm: 0o7},
+				{Tag: aclTagGroupObj, ID: aclUndefinedID, Perm: 0o5},
+				{Tag: aclTagMask, ID: aclUndefinedID, Perm: 0o5},
+				{Tag: aclTagOther, ID: aclUndefinedID, Perm: 0o0},
+			},
+			assert.NoError,
+		},
+		{"short-other", "o:r", aclSpec{{Tag: aclTagOther, ID: aclUndefinedID, Perm: 0o4}}, assert.NoError},
+		{"empty", "", nil, assert.Error},
+		{"invalid-tag", "x:2000:rwx", nil, assert.Error},
+		{"user-name", "u:postgres:rwx", nil, assert.Error},
+		{"id-for-mask", "m:2000:rwx", nil, assert.Error},
+		{"invalid-perm", "u:2000:rws", nil, assert.Error},
+		{"missing-perm", "u:2000:", nil, assert.Error},
+		{"missing-id-part", "u:rwx", nil, assert.Error},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseACL(tt.expr)
+			if !tt.wantErr(t, err, fmt.Sprintf("parseACL(%v)", tt.expr)) {
+				return
+			}
+			assert.Equalf(t, tt.want, got, "parseACL(%v)", tt.expr)
+		})
+	}
+}
+
+func Test_aclSpec_apply(t *testing.T) {
+	type args struct {
+		entries []aclEntry
+		mode    os.FileMode
+		isDir   bool
+	}
+	withMask := append(aclFromMode(0o750), aclEntry{Tag: aclTagMask, Perm: 0o5, ID: aclUndefinedID})
+	tests := []struct {
+		name string
+		expr string
+		args args
+		want []aclEntry
+	}{
+		{
+			"add-named-user",
+			"u:2000:rwX",
+			args{aclFromMode(0o644), 0o644, false},
+			[]aclEntry{
+				{Tag: aclTagUserObj, Perm: 0o6, ID: aclUndefinedID},
+				{Tag: aclTagUser, Perm: 0o6, ID: 2000},
+				{Tag: aclTagGroupObj, Perm: 0o4, ID: aclUndefinedID},
+				{Tag: aclTagMask, Perm: 0o6, ID: aclUndefinedID},
+				{Tag: aclTagOther, Perm: 0o4, ID: aclUndefinedID},
+			},
+		},
+		{
+			"conditional-exec-dir",
+			"g:3000:rX",
+			args{aclFromMode(0o700), 0o700, true},
+			[]aclEntry{
+				{Tag: aclTagUserObj, Perm: 0o7, ID: aclUndefinedID},
+				{Tag: aclTagGroupObj, Perm: 0o0, ID: aclUndefinedID},
+				{Tag: aclTagGroup, Perm: 0o5, ID: 3000},
+				{Tag: aclTagMask, Perm: 0o5, ID: aclUndefinedID},
+				{Tag: aclTagOther, Perm: 0o0, ID: aclUndefinedID},
+			},
+		},
+		{
+			"replace-and-recalculate-mask",
+			"g::rwx",
+			args{withMask, 0o750, true},
+			[]aclEntry{
+				{Tag: aclTagUserObj, Perm: 0o7, ID: aclUndefinedID},
+				{Tag: aclTagGroupObj, Perm: 0o7, ID: aclUndefinedID},
+				{Tag: aclTagMask, Perm: 0o7, ID: aclUndefinedID},
+				{Tag: aclTagOther, Perm: 0o0, ID: aclUndefinedID},
+			},
+		},
+		{
+			"explicit-mask",
+			"u:2000:rwx,m::r",
+			args{aclFromMode(0o600), 0o600, false},
+			[]aclEntry{
+				{Tag: aclTagUserObj, Perm: 0o6, ID: aclUndefinedID},
+				{Tag: aclTagUser, Perm: 0o7, ID: 2000},
+				{Tag: aclTagGroupObj, Perm: 0o0, ID: aclUndefinedID},
+				{Tag: aclTagMask, Perm: 0o4, ID: aclUndefinedID},
+				{Tag: aclTagOther, Perm: 0o0, ID: aclUndefinedID},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, err := parseACL(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equalf(t, tt.want, spec.apply(tt.args.entries, tt.args.mode, tt.args.isDir), "apply(%v)", tt.args.entries)
+		})
+	}
+}
+
+func Test_encodeACL(t *testing.T) {
+	entries := []aclEntry{
+		{Tag: aclTagUserObj, Perm: 0o7, ID: aclUndefinedID},
+		{Tag: aclTagUser, Perm: 0o5, ID: 2000},
+		{Tag: aclTagGroupObj, Perm: 0o5, ID: aclUndefinedID},
+		{Tag: aclTagMask, Perm: 0o5, ID: aclUndefinedID},
+		{Tag: aclTagOther, Perm: 0o0, ID: aclUndefinedID},
+	}
+	data := encodeACL(entries)
+	assert.Equal(t, []byte{2, 0, 0, 0, 1, 0, 7, 0, 0xff, 0xff, 0xff, 0xff}, data[:12])
+	decoded, err := decodeACL(data)
+	assert.NoError(t, err)
+	assert.Equal(t, entries, decoded)
+
+	_, err = decodeACL(data[:10])
+	assert.Error(t, err)
+}
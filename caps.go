@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"strings"
+)
+
+const (
+	fcapsXattr string = "security.capability"
+
+	vfsCapRevision2     uint32 = 0x02000000
+	vfsCapRevision3     uint32 = 0x03000000
+	vfsCapFlagEffective uint32 = 0x000001
+	vfsCapV2Size               = 20
+	vfsCapV3Size               = 24
+)
+
+var capNames = map[string]int{
+	"cap_chown":              unix.CAP_CHOWN,
+	"cap_dac_override":       unix.CAP_DAC_OVERRIDE,
+	"cap_dac_read_search":    unix.CAP_DAC_READ_SEARCH,
+	"cap_fowner":             unix.CAP_FOWNER,
+	"cap_fsetid":             unix.CAP_FSETID,
+	"cap_kill":               unix.CAP_KILL,
+	"cap_setgid":             unix.CAP_SETGID,
+	"cap_setuid":             unix.CAP_SETUID,
+	"cap_setpcap":            unix.CAP_SETPCAP,
+	"cap_linux_immutable":    unix.CAP_LINUX_IMMUTABLE,
+	"cap_net_bind_service":   unix.CAP_NET_BIND_SERVICE,
+	"cap_net_broadcast":      unix.CAP_NET_BROADCAST,
+	"cap_net_admin":          unix.CAP_NET_ADMIN,
+	"cap_net_raw":            unix.CAP_NET_RAW,
+	"cap_ipc_lock":           unix.CAP_IPC_LOCK,
+	"cap_ipc_owner":          unix.CAP_IPC_OWNER,
+	"cap_sys_module":         unix.CAP_SYS_MODULE,
+	"cap_sys_rawio":          unix.CAP_SYS_RAWIO,
+	"cap_sys_chroot":         unix.CAP_SYS_CHROOT,
+	"cap_sys_ptrace":         unix.CAP_SYS_PTRACE,
+	"cap_sys_pacct":          unix.CAP_SYS_PACCT,
+	"cap_sys_admin":          unix.CAP_SYS_ADMIN,
+	"cap_sys_boot":           unix.CAP_SYS_BOOT,
+	"cap_sys_nice":           unix.CAP_SYS_NICE,
+	"cap_sys_resource":       unix.CAP_SYS_RESOURCE,
+	"cap_sys_time":           unix.CAP_SYS_TIME,
+	"cap_sys_tty_config":     unix.CAP_SYS_TTY_CONFIG,
+	"cap_mknod":              unix.CAP_MKNOD,
+	"cap_lease":              unix.CAP_LEASE,
+	"cap_audit_write":        unix.CAP_AUDIT_WRITE,
+	"cap_audit_control":      unix.CAP_AUDIT_CONTROL,
+	"cap_setfcap":            unix.CAP_SETFCAP,
+	"cap_mac_override":       unix.CAP_MAC_OVERRIDE,
+	"cap_mac_admin":          unix.CAP_MAC_ADMIN,
+	"cap_syslog":             unix.CAP_SYSLOG,
+	"cap_wake_alarm":         unix.CAP_WAKE_ALARM,
+	"cap_block_suspend":      unix.CAP_BLOCK_SUSPEND,
+	"cap_audit_read":         unix.CAP_AUDIT_READ,
+	"cap_perfmon":            unix.CAP_PERFMON,
+	"cap_bpf":                unix.CAP_BPF,
+	"cap_checkpoint_restore": unix.CAP_CHECKPOINT_RESTORE,
+}
+
+// fileCaps is the file capabilities of a binary
+type fileCaps struct {
+	Permitted   uint64
+	Inheritable uint64
+	// Raise the permitted capabilities to the effective set on execve(2)
+	Effective bool
+}
+
+// parseFileCaps parses the file capabilities in the text format of setcap(8), such as cap_net_bind_service=+ep.
+// Clauses are separated by spaces, each of them is a comma separated capability list followed by one or more
+// operators of =, + and - with flags made of e, i and p. The capability list can be "all" or omitted for all of the
+// capabilities. As the effective set of a file is a single bit, it's raised if any capability is effective.
+func parseFileCaps(text string) (fileCaps, error) {
+	var caps fileCaps
+	var effective uint64
+	clauses := strings.Fields(text)
+	if len(clauses) == 0 {
+		return caps, fmt.Errorf("Empty file capabilities")
+	}
+	for _, clause := range clauses {
+		index := strings.IndexAny(clause, "=+-")
+		if index == -1 {
+			return caps, fmt.Errorf("Missing operator in file capabilities clause %q", clause)
+		}
+		var bits uint64
+		capList := clause[:index]
+		if capList == "" || capList == "all" {
+			for _, value := range capNames {
+				bits |= 1 << value
+			}
+		} else {
+			for _, name := range strings.Split(capList, ",") {
+				value, ok := capNames[strings.ToLower(name)]
+				if !ok {
+					return caps, fmt.Errorf("Unknown capability %q in file capabilities clause %q", name, clause)
+				}
+				bits |= 1 << value
+			}
+		}
+		rest := clause[index:]
+		for rest != "" {
+			operator := rest[0]
+			end := strings.IndexAny(rest[1:], "=+-")
+			if end == -1 {
+				end = len(rest)
+			} else {
+				end++
+			}
+			flags := rest[1:end]
+			rest = rest[end:]
+			if operator != '=' && flags == "" {
+				return caps, fmt.Errorf("Missing flags after %q in file capabilities clause %q", operator, clause)
+			}
+			if operator == '=' {
+				caps.Permitted &^= bits
+				caps.Inheritable &^= bits
+				effective &^= bits
+			}
+			for _, flag := range flags {
+				var set *uint64
+				switch flag {
+				case 'e':
+					set = &effective
+				case 'i':
+					set = &caps.Inheritable
+				case 'p':
+					set = &caps.Permitted
+				default:
+					return caps, fmt.Errorf("Invalid flag %q in file capabilities clause %q", flag, clause)
+				}
+				if operator == '-' {
+					*set &^= bits
+				} else {
+					*set |= bits
+				}
+			}
+		}
+	}
+	caps.Effective = effective != 0
+	return caps, nil
+}
+
+// encode encodes the file capabilities into the xattr format. If rootUID is not negative, the version 3 format is
+// used, so that the capabilities only take effect in the user namespace with rootUID as its root user.
+func (caps fileCaps) encode(rootUID int) []byte {
+	magic := vfsCapRevision2
+	size := vfsCapV2Size
+	if rootUID >= 0 {
+		magic = vfsCapRevision3
+		size = vfsCapV3Size
+	}
+	if caps.Effective {
+		magic |= vfsCapFlagEffective
+	}
+	data := make([]byte, size)
+	binary.LittleEndian.PutUint32(data, magic)
+	binary.LittleEndian.PutUint32(data[4:], uint32(caps.Permitted))
+	binary.LittleEndian.PutUint32(data[8:], uint32(caps.Inheritable))
+	binary.LittleEndian.PutUint32(data[12:], uint32(caps.Permitted>>32))
+	binary.LittleEndian.PutUint32(data[16:], uint32(caps.Inheritable>>32))
+	if rootUID >= 0 {
+		binary.LittleEndian.PutUint32(data[20:], uint32(rootUID))
+	}
+	return data
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+	"testing"
+)
+
+func Test_parseFileCaps(t *testing.T) {
+	var allCaps uint64
+	for _, value := range capNames {
+		allCaps |= 1 << value
+	}
+	tests := []struct {
+		name    string
+		text    string
+		want    fileCaps
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{"add", "cap_net_bind_service+ep", fileCaps{Permitted: 1 << unix.CAP_NET_BIND_SERVICE, Effective: true}, assert.NoError},
+		{"set", "cap_net_bind_service=ep", fileCaps{Permitted: 1 << unix.CAP_NET_BIND_SERVICE, Effective: true}, assert.NoError},
+		{
+			"list",
+			"cap_chown,CAP_FOWNER=pi",
+			fileCaps{Permitted: 1<<unix.CAP_CHOWN | 1<<unix.CAP_FOWNER, Inheritable: 1<<unix.CAP_CHOWN | 1<<unix.CAP_FOWNER},
+			assert.NoError,
+		},
+		{"high-cap", "cap_bpf+p", fileCaps{Permitted: 1 << unix.CAP_BPF}, assert.NoError},
+		{"multiple-clauses", "all=p cap_sys_admin-p", fileCaps{Permitted: allCaps &^ (1 << unix.CAP_SYS_ADMIN)}, assert.NoError},
+		{"multiple-ops", "cap_kill=p+e-p", fileCaps{Effective: true}, assert.NoError},
+		{"empty", "", fileCaps{}, assert.Error},
+		{"unknown-cap", "cap_fly+ep", fileCaps{}, assert.Error},
+		{"missing-operator", "cap_kill", fileCaps{}, assert.Error},
+		{"missing-flags", "cap_kill+", fileCaps{}, assert.Error},
+		{"invalid-flag", "cap_kill+x", fileCaps{}, assert.Error},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFileCaps(tt.text)
+			if !tt.wantErr(t, err, fmt.Sprintf("parseFileCaps(%v)", tt.text)) {
+				return
+			}
+			assert.Equalf(t, tt.want, got, "parseFileCaps(%v)", tt.text)
+		})
+	}
+}
+
+func Test_fileCaps_encode(t *testing.T) {
+	caps := fileCaps{Permitted: 1<<unix.CAP_NET_BIND_SERVICE | 1<<unix.CAP_BPF, Effective: true}
+	assert.Equal(t, []byte{
+		0x01, 0x00, 0x00, 0x02,
+		0x00, 0x04, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+		0x80, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+	}, caps.encode(-1))
+	assert.Equal(t, []byte{
+		0x01, 0x00, 0x00, 0x03,
+		0x00, 0x04, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+		0x80, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+		0xa0, 0x86, 0x01, 0x00,
+	}, caps.encode(100000))
+}
@@ -10,10 +10,30 @@ import (
 )
 
 const (
-	PolicyRecursive string = "recursive"
-	PolicyRootOnly         = "root-only"
+	PolicyRecursive      string = "recursive"
+	PolicyRootOnly              = "root-only"
+	PolicyFSGroup               = "fsgroup"
+	PolicyOnRootMismatch        = "on-root-mismatch"
+	PolicyChildrenOnly          = "children-only"
 )
 
+const (
+	CreateDir  string = "dir"
+	CreateFile        = "file"
+)
+
+var Policies = []string{PolicyRecursive, PolicyRootOnly, PolicyFSGroup, PolicyOnRootMismatch, PolicyChildrenOnly}
+
+const (
+	StagePrestart        string = "prestart"
+	StageCreateRuntime          = "createRuntime"
+	StageCreateContainer        = "createContainer"
+	StageStartContainer         = "startContainer"
+	StagePoststop               = "poststop"
+)
+
+var Stages = []string{StagePrestart, StageCreateRuntime, StageCreateContainer, StageStartContainer, StagePoststop}
+
 type ChownRequest struct {
 	// The name of chown
 	Name string
@@ -23,10 +43,62 @@ type ChownRequest struct {
 	User int
 	// The group (gid) to set for the path
 	Group int
+	// The user name to be resolved against the container's /etc/passwd
+	UserName string
+	// The group name to be resolved against the container's /etc/group
+	GroupName string
+	// Use the user and group of the container's process as the owner
+	ProcessOwner bool
+	// Use the uid, gid and mode options of the mount at the path as the owner and the default mode
+	MountOptionsOwner bool
 	// The mode of file path to change
 	Mode os.FileMode
+	// The mode of directories to change recursively
+	DirMode os.FileMode
+	// The mode of regular files to change recursively
+	FileMode os.FileMode
+	// The chmod(1) style symbolic mode expression of file path to change
+	SymbolicMode string
+	// The chmod(1) style symbolic mode expression of directories to change recursively
+	SymbolicDirMode string
+	// The chmod(1) style symbolic mode expression of regular files to change recursively
+	SymbolicFileMode string
 	// The policy for chown
 	Policy string
+	// The number of directories to walk in parallel for recursive policies
+	Concurrency int
+	// Walk into other filesystems mounted under the path for recursive policies
+	CrossMounts bool
+	// The glob patterns of files to include for recursive policies
+	Include []string
+	// The glob patterns of files to exclude for recursive policies
+	Exclude []string
+	// The max depth to walk into for recursive policies, the root is at depth 0, and zero means unlimited
+	MaxDepth int
+	// Only change the owner of files currently owned by the owner in [UID][:GID] format
+	From string
+	// Create the path as a dir or file if it doesn't exist
+	Create string
+	// The owner in UID[:GID] format of the parent directories created for the path
+	ParentOwner string
+	// The setfacl(1) style ACL entries to add to files
+	ACL string
+	// The setfacl(1) style default ACL entries to add to directories for inheritance
+	DefaultACL string
+	// The SELinux context to label files with
+	SELinuxLabel string
+	// Label files with the mount label of the container if SELinuxLabel is not provided, either shared or private
+	SELinuxRelabel string
+	// The xattrs to set on the path, keyed by the names, with values encoded like setfattr(1) takes or XattrRemove
+	Xattrs map[string]string
+	// The setcap(8) style file capabilities to set on the path
+	FCaps string
+	// The hook stages to perform the request in, createContainer if empty
+	Stages []string
+	// Select the mounts with the source path or a segment of it as the target paths instead of Path
+	MountSource string
+	// Select the mounts with the type as the target paths instead of Path
+	MountType string
 }
 
 const (
@@ -35,6 +107,46 @@ const (
 	annotationOwnerArg  string = "owner"
 	annotationPolicyArg string = "policy"
 	annotationModeArg   string = "mode"
+	annotationGroupArg  string = "group"
+	annotationDirMode   string = "dirMode"
+	annotationFileMode  string = "fileMode"
+
+	// The arguments of recursive walks
+	annotationConcurrencyArg string = "concurrency"
+	annotationCrossMountsArg string = "crossMounts"
+	annotationIncludeArg     string = "include"
+	annotationExcludeArg     string = "exclude"
+	annotationMaxDepthArg    string = "maxDepth"
+	annotationFromArg        string = "from"
+
+	// The arguments for creating missing paths
+	annotationCreateArg      string = "create"
+	annotationParentOwnerArg string = "parentOwner"
+
+	// The arguments for selecting the mounts as the target paths instead of the path argument
+	annotationMountSourceArg string = "mount.source"
+	annotationMountTypeArg   string = "mount.type"
+
+	// The arguments for POSIX ACLs
+	annotationACLArg        string = "acl"
+	annotationDefaultACLArg string = "defaultAcl"
+
+	// The arguments for SELinux labels
+	annotationSELinuxLabelArg   string = "selinuxLabel"
+	annotationSELinuxRelabelArg string = "selinuxRelabel"
+
+	// The arguments for file capabilities and xattrs
+	annotationFCapsArg string = "fcaps"
+	// The prefix of the argument for setting xattr, followed by the xattr name
+	annotationXattrArgPrefix string = "xattr."
+
+	// The argument for the hook stages to perform the request in
+	annotationStageArg string = "stage"
+
+	// The special owner value for using the user and group of the container's process
+	OwnerProcess string = "@process"
+	// The special owner value for using the uid, gid and mode options of the mount at the path
+	OwnerMountOptions string = "@mount-options"
 )
 
 func parseOwner(owner string) (int, int, error) {
@@ -56,14 +168,247 @@ func parseOwner(owner string) (int, int, error) {
 	return uid, gid, nil
 }
 
-func parseChownRequests(annotations map[string]string) map[string]ChownRequest {
+// parseFrom parses the current owner to match in [UID][:GID] format like the --from argument of chown(1), the omitted
+// part is returned as -1, meaning matching any
+func parseFrom(from string) (int, int, error) {
+	parts := strings.Split(from, ":")
+	if len(parts) > 2 {
+		return 0, 0, fmt.Errorf("Expected only one or two parts in the from owner but got %d instead", len(parts))
+	}
+	ids := []int{-1, -1}
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		id, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, 0, err
+		}
+		if id < 0 {
+			return 0, 0, fmt.Errorf("Negative uid or gid is not allowed")
+		}
+		ids[i] = id
+	}
+	if ids[0] == -1 && ids[1] == -1 {
+		return 0, 0, fmt.Errorf("Expected uid or gid in the from owner but got empty value instead")
+	}
+	return ids[0], ids[1], nil
+}
+
+// parseOwnerNames parses owner value in USER[:GROUP] format with names, which will be resolved later against the
+// container's databases
+func parseOwnerNames(owner string) (string, string, error) {
+	parts := strings.Split(owner, ":")
+	if len(parts) > 2 {
+		return "", "", fmt.Errorf("Expected only one or two parts in the owner but got %d instead", len(parts))
+	}
+	if parts[0] == "" {
+		return "", "", fmt.Errorf("Expected user name in the owner but got empty value instead")
+	}
+	if len(parts) == 1 {
+		return parts[0], "", nil
+	}
+	if parts[1] == "" {
+		return "", "", fmt.Errorf("Expected group name in the owner but got empty value instead")
+	}
+	return parts[0], parts[1], nil
+}
+
+// parseGlobs parses comma separated glob patterns
+func parseGlobs(value string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(value, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		err := validateGlob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, pattern)
+	}
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("No glob pattern provided")
+	}
+	return patterns, nil
+}
+
+// parseOwnerArg parses the owner argument value and sets it to the given request
+func parseOwnerArg(request *ChownRequest, value string) error {
+	if value == OwnerProcess {
+		request.ProcessOwner = true
+		return nil
+	}
+	if value == OwnerMountOptions {
+		request.MountOptionsOwner = true
+		return nil
+	}
+	uid, gid, err := parseOwner(value)
+	if err == nil {
+		if uid < 0 || gid < 0 {
+			return fmt.Errorf("Negative uid or gid is not allowed")
+		}
+		request.User = uid
+		request.Group = gid
+		return nil
+	}
+	userName, groupName, err := parseOwnerNames(value)
+	if err != nil {
+		return err
+	}
+	request.UserName = userName
+	request.GroupName = groupName
+	return nil
+}
+
+// hasOwner returns true if any kind of owner is provided for the request
+func (request ChownRequest) hasOwner() bool {
+	return (request.User >= 0 && request.Group >= 0) || request.UserName != "" || request.GroupName != "" ||
+		request.ProcessOwner || request.MountOptionsOwner
+}
+
+// hasACL returns true if any ACL is provided for the request
+func (request ChownRequest) hasACL() bool {
+	return request.ACL != "" || request.DefaultACL != ""
+}
+
+// hasSELinuxLabel returns true if the files need to be labeled for SELinux
+func (request ChownRequest) hasSELinuxLabel() bool {
+	return request.SELinuxLabel != "" || request.SELinuxRelabel != ""
+}
+
+// hasXattr returns true if any xattr or file capabilities is provided for the request
+func (request ChownRequest) hasXattr() bool {
+	return len(request.Xattrs) > 0 || request.FCaps != ""
+}
+
+// runsInStage returns true if the request should be performed in the given hook stage
+func (request ChownRequest) runsInStage(stage string) bool {
+	if len(request.Stages) == 0 {
+		return stage == StageCreateContainer
+	}
+	for _, requestStage := range request.Stages {
+		if requestStage == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// hasMountSelector returns true if the target paths are selected by mount attributes instead of the path
+func (request ChownRequest) hasMountSelector() bool {
+	return request.MountSource != "" || request.MountType != ""
+}
+
+// hasRecursiveMode returns true if any mode to change recursively is provided for the request
+func (request ChownRequest) hasRecursiveMode() bool {
+	return request.DirMode != 0 || request.FileMode != 0 || request.SymbolicDirMode != "" || request.SymbolicFileMode != ""
+}
+
+// hasMode returns true if any kind of mode is provided for the request
+func (request ChownRequest) hasMode() bool {
+	return request.Mode != 0 || request.SymbolicMode != "" || request.hasRecursiveMode()
+}
+
+// requestSymbolicModes holds the parsed symbolic modes of a request, nil for the ones not provided
+type requestSymbolicModes struct {
+	Mode     symbolicMode
+	DirMode  symbolicMode
+	FileMode symbolicMode
+}
+
+// parseSymbolicModes parses the symbolic mode expressions of the request
+func (request ChownRequest) parseSymbolicModes() (requestSymbolicModes, error) {
+	modes := requestSymbolicModes{}
+	var err error
+	if request.SymbolicMode != "" {
+		modes.Mode, err = parseSymbolicMode(request.SymbolicMode)
+		if err != nil {
+			return modes, err
+		}
+	}
+	if request.SymbolicDirMode != "" {
+		modes.DirMode, err = parseSymbolicMode(request.SymbolicDirMode)
+		if err != nil {
+			return modes, err
+		}
+	}
+	if request.SymbolicFileMode != "" {
+		modes.FileMode, err = parseSymbolicMode(request.SymbolicFileMode)
+		if err != nil {
+			return modes, err
+		}
+	}
+	return modes, nil
+}
+
+func isValidStage(stage string) bool {
+	for _, validStage := range Stages {
+		if stage == validStage {
+			return true
+		}
+	}
+	return false
+}
+
+// parseStages parses comma separated hook stages
+func parseStages(value string) ([]string, error) {
+	var stages []string
+	for _, stage := range strings.Split(value, ",") {
+		stage = strings.TrimSpace(stage)
+		if stage == "" {
+			continue
+		}
+		if !isValidStage(stage) {
+			return nil, fmt.Errorf("Unknown stage %s, needs to be one of %s", stage, strings.Join(Stages, ", "))
+		}
+		stages = append(stages, stage)
+	}
+	if len(stages) == 0 {
+		return nil, fmt.Errorf("No stage provided")
+	}
+	return stages, nil
+}
+
+// filterRequestsByStage returns the requests to be performed in the given hook stage
+func filterRequestsByStage(requests map[string]ChownRequest, stage string) map[string]ChownRequest {
+	filteredRequests := map[string]ChownRequest{}
+	for key, request := range requests {
+		if !request.runsInStage(stage) {
+			log.Debugf("Request %s is not for %s stage, skip", request.Name, stage)
+			continue
+		}
+		filteredRequests[key] = request
+	}
+	return filteredRequests
+}
+
+func isValidPolicy(policy string) bool {
+	for _, validPolicy := range Policies {
+		if policy == validPolicy {
+			return true
+		}
+	}
+	return false
+}
+
+// parseChownRequests parses chown requests from the annotations. The defaultOwner, if not empty, is used as the
+// owner argument value for requests without one. The requests are keyed by their paths, so that only one request is
+// performed for a path, except for the ones selecting mounts, which are keyed by their names instead, as the target
+// paths are unknown until the mounts are selected. A name never contains "/", so it cannot collide with a path.
+func parseChownRequests(annotations map[string]string, defaultOwner string) map[string]ChownRequest {
 	requests := map[string]ChownRequest{}
 	for key, value := range annotations {
 		if !strings.HasPrefix(key, annotationPrefix) {
 			continue
 		}
 		keySuffix := key[len(annotationPrefix):]
-		parts := strings.Split(keySuffix, ".")
+		parts := strings.SplitN(keySuffix, ".", 2)
+		if len(parts) < 2 {
+			log.Warnf("Missing chown argument in annotation %s, ignored", key)
+			continue
+		}
 		name, chownArg := parts[0], parts[1]
 		request, ok := requests[name]
 		if !ok {
@@ -80,26 +425,164 @@ func parseChownRequests(annotations map[string]string) map[string]ChownRequest {
 			}
 			request.Path = value
 		} else if chownArg == annotationOwnerArg {
-			uid, gid, err := parseOwner(value)
+			err := parseOwnerArg(&request, value)
 			if err != nil {
 				log.Warnf("Invalid owner argument for %s with error %s, ignored", name, err)
 				continue
 			}
-			if uid < 0 || gid < 0 {
-				log.Warnf("Invalid owner argument for %s with negative uid or gid, ignored", name)
+		} else if chownArg == annotationGroupArg {
+			gid, err := strconv.Atoi(value)
+			if value == "" || strings.Contains(value, ":") || (err == nil && gid < 0) {
+				log.Warnf("Invalid group argument %s for %s, ignored", value, name)
 				continue
 			}
-			request.User = uid
-			request.Group = gid
-		} else if chownArg == annotationPolicyArg {
-			request.Policy = value
-		} else if chownArg == annotationModeArg {
-			mode, err := strconv.ParseInt(value, 8, 32)
+			request.GroupName = value
+		} else if chownArg == annotationConcurrencyArg {
+			parsedConcurrency, err := strconv.Atoi(value)
+			if err != nil || parsedConcurrency < 1 {
+				log.Warnf("Invalid concurrency argument %s for request %s, needs to be a positive integer, ignored", value, name)
+				continue
+			}
+			request.Concurrency = parsedConcurrency
+		} else if chownArg == annotationCrossMountsArg {
+			crossMounts, err := strconv.ParseBool(value)
+			if err != nil {
+				log.Warnf("Invalid crossMounts argument %s for request %s, needs to be a boolean, ignored", value, name)
+				continue
+			}
+			request.CrossMounts = crossMounts
+		} else if chownArg == annotationIncludeArg || chownArg == annotationExcludeArg {
+			patterns, err := parseGlobs(value)
+			if err != nil {
+				log.Warnf("Invalid %s argument %s for request %s with error %s, ignored", chownArg, value, name, err)
+				continue
+			}
+			if chownArg == annotationIncludeArg {
+				request.Include = patterns
+			} else {
+				request.Exclude = patterns
+			}
+		} else if chownArg == annotationMaxDepthArg {
+			maxDepth, err := strconv.Atoi(value)
+			if err != nil || maxDepth < 1 {
+				log.Warnf("Invalid maxDepth argument %s for request %s, needs to be a positive integer, ignored", value, name)
+				continue
+			}
+			request.MaxDepth = maxDepth
+		} else if chownArg == annotationFromArg {
+			_, _, err := parseFrom(value)
+			if err != nil {
+				log.Warnf("Invalid from argument %s for request %s with error %s, ignored", value, name, err)
+				continue
+			}
+			request.From = value
+		} else if chownArg == annotationCreateArg {
+			if value != CreateDir && value != CreateFile {
+				log.Warnf("Invalid create argument %s for request %s, needs to be %s or %s, ignored", value, name, CreateDir, CreateFile)
+				continue
+			}
+			request.Create = value
+		} else if chownArg == annotationParentOwnerArg {
+			uid, gid, err := parseOwner(value)
+			if err != nil || uid < 0 || gid < 0 {
+				log.Warnf("Invalid parentOwner argument %s for request %s, needs to be in UID[:GID] format, ignored", value, name)
+				continue
+			}
+			request.ParentOwner = value
+		} else if chownArg == annotationMountSourceArg || chownArg == annotationMountTypeArg {
+			if value == "" {
+				log.Warnf("Empty %s argument for request %s, ignored", chownArg, name)
+				continue
+			}
+			if chownArg == annotationMountSourceArg {
+				request.MountSource = value
+			} else {
+				request.MountType = value
+			}
+		} else if chownArg == annotationACLArg || chownArg == annotationDefaultACLArg {
+			_, err := parseACL(value)
+			if err != nil {
+				log.Warnf("Invalid %s argument %s for request %s with error %s, ignored", chownArg, value, name, err)
+				continue
+			}
+			if chownArg == annotationACLArg {
+				request.ACL = value
+			} else {
+				request.DefaultACL = value
+			}
+		} else if chownArg == annotationSELinuxLabelArg {
+			err := validateSELinuxLabel(value)
+			if err != nil {
+				log.Warnf("Invalid selinuxLabel argument %s for request %s with error %s, ignored", value, name, err)
+				continue
+			}
+			request.SELinuxLabel = value
+		} else if chownArg == annotationSELinuxRelabelArg {
+			if value != SELinuxRelabelShared && value != SELinuxRelabelPrivate {
+				log.Warnf(
+					"Invalid selinuxRelabel argument %s for request %s, needs to be %s or %s, ignored",
+					value, name, SELinuxRelabelShared, SELinuxRelabelPrivate,
+				)
+				continue
+			}
+			request.SELinuxRelabel = value
+		} else if strings.HasPrefix(chownArg, annotationXattrArgPrefix) {
+			xattrName := chownArg[len(annotationXattrArgPrefix):]
+			err := validateXattrName(xattrName)
+			if err == nil && value != XattrRemove {
+				_, err = decodeXattrValue(value)
+			}
 			if err != nil {
-				log.Warnf("Invalid mode argument %s for request %s, needs to be an octal integer, ignored", value, name)
+				log.Warnf("Invalid %s argument %s for request %s with error %s, ignored", chownArg, value, name, err)
 				continue
 			}
-			request.Mode = os.FileMode(mode)
+			if request.Xattrs == nil {
+				request.Xattrs = map[string]string{}
+			}
+			request.Xattrs[xattrName] = value
+		} else if chownArg == annotationFCapsArg {
+			_, err := parseFileCaps(value)
+			if err != nil {
+				log.Warnf("Invalid fcaps argument %s for request %s with error %s, ignored", value, name, err)
+				continue
+			}
+			request.FCaps = value
+		} else if chownArg == annotationStageArg {
+			stages, err := parseStages(value)
+			if err != nil {
+				log.Warnf("Invalid stage argument %s for request %s with error %s, ignored", value, name, err)
+				continue
+			}
+			request.Stages = stages
+		} else if chownArg == annotationPolicyArg {
+			request.Policy = value
+		} else if chownArg == annotationModeArg || chownArg == annotationDirMode || chownArg == annotationFileMode {
+			var octalMode os.FileMode
+			var symbolicMode string
+			mode, err := strconv.ParseUint(value, 8, 12)
+			if err == nil {
+				octalMode = unixMode(uint32(mode))
+			} else {
+				_, err = parseSymbolicMode(value)
+				if err != nil {
+					log.Warnf(
+						"Invalid %s argument %s for request %s, needs to be an octal integer or a symbolic mode with error %s, ignored",
+						chownArg, value, name, err,
+					)
+					continue
+				}
+				symbolicMode = value
+			}
+			if chownArg == annotationModeArg {
+				request.Mode = octalMode
+				request.SymbolicMode = symbolicMode
+			} else if chownArg == annotationDirMode {
+				request.DirMode = octalMode
+				request.SymbolicDirMode = symbolicMode
+			} else {
+				request.FileMode = octalMode
+				request.SymbolicFileMode = symbolicMode
+			}
 		} else {
 			log.Warnf("Invalid chown argument %s for request %s, ignored", chownArg, name)
 			continue
@@ -110,21 +593,44 @@ func parseChownRequests(annotations map[string]string) map[string]ChownRequest {
 	filteredRequests := map[string]ChownRequest{}
 	for _, request := range requests {
 		var emptyValue = false
-		if request.Path == "" {
+		// The default owner only applies to the requests with nothing else to change, so that the ones only changing the
+		// mode, ACLs, labels or xattrs don't change the owner unexpectedly
+		if !request.hasOwner() && !request.hasMode() && !request.hasACL() && !request.hasSELinuxLabel() &&
+			!request.hasXattr() && defaultOwner != "" {
+			err := parseOwnerArg(&request, defaultOwner)
+			if err != nil {
+				log.Warnf("Invalid default owner %s for %s with error %s, ignored", defaultOwner, request.Name, err)
+			}
+		}
+		if request.Path == "" && !request.hasMountSelector() {
 			log.Warnf("Empty path argument value for %s, ignored", request.Name)
 			emptyValue = true
 		}
-		if (request.User == -1 || request.Group == -1) && request.Mode == 0 {
-			log.Warnf("Empty owner and mode argument value for %s, ignored", request.Name)
+		if request.Path != "" && request.hasMountSelector() {
+			log.Warnf("Both path and mount arguments provided for %s, ignored", request.Name)
+			emptyValue = true
+		}
+		if !request.hasOwner() && !request.hasMode() && !request.hasACL() && !request.hasSELinuxLabel() &&
+			!request.hasXattr() {
+			log.Warnf("Empty owner, mode, acl, selinuxLabel, xattr and fcaps argument value for %s, ignored", request.Name)
 			emptyValue = true
 		}
-		if request.Policy != "" && request.Policy != PolicyRecursive && request.Policy != PolicyRootOnly {
+		if request.Policy != "" && !isValidPolicy(request.Policy) {
 			log.Warnf("Invalid policy argument value %s for %s, ignored", request.Policy, request.Name)
 			emptyValue = true
 		}
+		if request.Policy == PolicyFSGroup && request.GroupName == "" {
+			log.Warnf("Empty group argument value for %s with fsgroup policy, ignored", request.Name)
+			emptyValue = true
+		}
 		if emptyValue {
 			continue
 		}
+		if request.hasMountSelector() {
+			// The target paths are unknown until the mounts are selected
+			filteredRequests[request.Name] = request
+			continue
+		}
 		filteredRequests[request.Path] = request
 	}
 	return filteredRequests
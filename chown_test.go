@@ -3,13 +3,15 @@ package main
 import (
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"os"
 	"reflect"
 	"testing"
 )
 
 func Test_parseChownRequests(t *testing.T) {
 	type args struct {
-		annotations map[string]string
+		annotations  map[string]string
+		defaultOwner string
 	}
 	tests := []struct {
 		name string
@@ -42,6 +44,54 @@ func Test_parseChownRequests(t *testing.T) {
 			"/path/to/root": {Name: "data", Path: "/path/to/root", User: -1, Group: -1, Mode: 0o755},
 		},
 		},
+		{
+			"special-bits-mode", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path": "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.mode": "2775",
+		}}, map[string]ChownRequest{
+			"/path/to/root": {Name: "data", Path: "/path/to/root", User: -1, Group: -1, Mode: os.ModeSetgid | 0o775},
+		},
+		},
+		{
+			"dir-and-file-mode-only", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":     "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.dirMode":  "775",
+			"com.launchplatform.oci-hooks.mount-chown.data.fileMode": "664",
+		}}, map[string]ChownRequest{
+			"/path/to/root": {
+				Name:     "data",
+				Path:     "/path/to/root",
+				User:     -1,
+				Group:    -1,
+				DirMode:  0o775,
+				FileMode: 0o664,
+			},
+		},
+		},
+		{
+			"symbolic-modes", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":     "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.mode":     "u+rwx,o-rwx",
+			"com.launchplatform.oci-hooks.mount-chown.data.dirMode":  "u+rwX,g+rX",
+			"com.launchplatform.oci-hooks.mount-chown.data.fileMode": "g=u",
+		}}, map[string]ChownRequest{
+			"/path/to/root": {
+				Name:             "data",
+				Path:             "/path/to/root",
+				User:             -1,
+				Group:            -1,
+				SymbolicMode:     "u+rwx,o-rwx",
+				SymbolicDirMode:  "u+rwX,g+rX",
+				SymbolicFileMode: "g=u",
+			},
+		},
+		},
+		{
+			"invalid-dir-mode", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":    "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.dirMode": "u+z",
+		}}, map[string]ChownRequest{},
+		},
 		{
 			"recursive-policy", args{annotations: map[string]string{
 			"com.launchplatform.oci-hooks.mount-chown.data.path":   "/path/to/root",
@@ -72,6 +122,318 @@ func Test_parseChownRequests(t *testing.T) {
 			},
 		},
 		},
+		{
+			"on-root-mismatch-policy", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":   "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.owner":  "2000:2000",
+			"com.launchplatform.oci-hooks.mount-chown.data.policy": PolicyOnRootMismatch,
+		}}, map[string]ChownRequest{
+			"/path/to/root": {
+				Name:   "data",
+				Path:   "/path/to/root",
+				User:   2000,
+				Group:  2000,
+				Policy: PolicyOnRootMismatch,
+			},
+		},
+		},
+		{
+			"fsgroup-policy", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":   "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.group":  "3000",
+			"com.launchplatform.oci-hooks.mount-chown.data.policy": PolicyFSGroup,
+		}}, map[string]ChownRequest{
+			"/path/to/root": {
+				Name:      "data",
+				Path:      "/path/to/root",
+				User:      -1,
+				Group:     -1,
+				GroupName: "3000",
+				Policy:    PolicyFSGroup,
+			},
+		},
+		},
+		{
+			"fsgroup-policy-missing-group", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":   "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.owner":  "2000:2000",
+			"com.launchplatform.oci-hooks.mount-chown.data.policy": PolicyFSGroup,
+		}}, map[string]ChownRequest{},
+		},
+		{
+			"group-override", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":  "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.owner": "2000:2000",
+			"com.launchplatform.oci-hooks.mount-chown.data.group": "shared",
+		}}, map[string]ChownRequest{
+			"/path/to/root": {Name: "data", Path: "/path/to/root", User: 2000, Group: 2000, GroupName: "shared"},
+		},
+		},
+		{
+			"invalid-group", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":  "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.group": "-1",
+		}}, map[string]ChownRequest{},
+		},
+		{
+			"concurrency", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":        "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.owner":       "2000:2000",
+			"com.launchplatform.oci-hooks.mount-chown.data.concurrency": "8",
+		}}, map[string]ChownRequest{
+			"/path/to/root": {Name: "data", Path: "/path/to/root", User: 2000, Group: 2000, Concurrency: 8},
+		},
+		},
+		{
+			"invalid-concurrency", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":        "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.owner":       "2000:2000",
+			"com.launchplatform.oci-hooks.mount-chown.data.concurrency": "0",
+		}}, map[string]ChownRequest{
+			"/path/to/root": {Name: "data", Path: "/path/to/root", User: 2000, Group: 2000},
+		},
+		},
+		{
+			"cross-mounts", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":        "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.owner":       "2000:2000",
+			"com.launchplatform.oci-hooks.mount-chown.data.crossMounts": "true",
+		}}, map[string]ChownRequest{
+			"/path/to/root": {Name: "data", Path: "/path/to/root", User: 2000, Group: 2000, CrossMounts: true},
+		},
+		},
+		{
+			"include-and-exclude", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":    "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.owner":   "2000:2000",
+			"com.launchplatform.oci-hooks.mount-chown.data.include": "**/*.sock, data/**",
+			"com.launchplatform.oci-hooks.mount-chown.data.exclude": "cache/**,.git,",
+		}}, map[string]ChownRequest{
+			"/path/to/root": {
+				Name:    "data",
+				Path:    "/path/to/root",
+				User:    2000,
+				Group:   2000,
+				Include: []string{"**/*.sock", "data/**"},
+				Exclude: []string{"cache/**", ".git"},
+			},
+		},
+		},
+		{
+			"invalid-exclude", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":    "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.owner":   "2000:2000",
+			"com.launchplatform.oci-hooks.mount-chown.data.exclude": "cache/[a-",
+		}}, map[string]ChownRequest{
+			"/path/to/root": {Name: "data", Path: "/path/to/root", User: 2000, Group: 2000},
+		},
+		},
+		{
+			"children-only-policy-with-max-depth", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":     "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.owner":    "2000:2000",
+			"com.launchplatform.oci-hooks.mount-chown.data.policy":   PolicyChildrenOnly,
+			"com.launchplatform.oci-hooks.mount-chown.data.maxDepth": "2",
+		}}, map[string]ChownRequest{
+			"/path/to/root": {
+				Name:     "data",
+				Path:     "/path/to/root",
+				User:     2000,
+				Group:    2000,
+				Policy:   PolicyChildrenOnly,
+				MaxDepth: 2,
+			},
+		},
+		},
+		{
+			"invalid-max-depth", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":     "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.owner":    "2000:2000",
+			"com.launchplatform.oci-hooks.mount-chown.data.maxDepth": "0",
+		}}, map[string]ChownRequest{
+			"/path/to/root": {Name: "data", Path: "/path/to/root", User: 2000, Group: 2000},
+		},
+		},
+		{
+			"from", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":  "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.owner": "2000:2000",
+			"com.launchplatform.oci-hooks.mount-chown.data.from":  "1000:1000",
+		}}, map[string]ChownRequest{
+			"/path/to/root": {Name: "data", Path: "/path/to/root", User: 2000, Group: 2000, From: "1000:1000"},
+		},
+		},
+		{
+			"invalid-from", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":  "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.owner": "2000:2000",
+			"com.launchplatform.oci-hooks.mount-chown.data.from":  "user",
+		}}, map[string]ChownRequest{
+			"/path/to/root": {Name: "data", Path: "/path/to/root", User: 2000, Group: 2000},
+		},
+		},
+		{
+			"create", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":        "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.owner":       "2000:2000",
+			"com.launchplatform.oci-hooks.mount-chown.data.create":      CreateDir,
+			"com.launchplatform.oci-hooks.mount-chown.data.parentOwner": "1000:1000",
+		}}, map[string]ChownRequest{
+			"/path/to/root": {
+				Name:        "data",
+				Path:        "/path/to/root",
+				User:        2000,
+				Group:       2000,
+				Create:      CreateDir,
+				ParentOwner: "1000:1000",
+			},
+		},
+		},
+		{
+			"invalid-create", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":        "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.owner":       "2000:2000",
+			"com.launchplatform.oci-hooks.mount-chown.data.create":      "socket",
+			"com.launchplatform.oci-hooks.mount-chown.data.parentOwner": "user",
+		}}, map[string]ChownRequest{
+			"/path/to/root": {Name: "data", Path: "/path/to/root", User: 2000, Group: 2000},
+		},
+		},
+		{
+			"mount-selector", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.mount.source": "dataset",
+			"com.launchplatform.oci-hooks.mount-chown.data.mount.type":   "bind",
+			"com.launchplatform.oci-hooks.mount-chown.data.owner":        "2000:2000",
+		}}, map[string]ChownRequest{
+			// Keyed by the name instead of the path, as the target paths are unknown until the mounts are selected
+			"data": {Name: "data", User: 2000, Group: 2000, MountSource: "dataset", MountType: "bind"},
+		},
+		},
+		{
+			"mount-selector-and-path", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data0.path":       "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data0.owner":      "2000:2000",
+			"com.launchplatform.oci-hooks.mount-chown.data1.mount.type": "tmpfs",
+			"com.launchplatform.oci-hooks.mount-chown.data1.owner":      "2000:2000",
+		}}, map[string]ChownRequest{
+			"/path/to/root": {Name: "data0", Path: "/path/to/root", User: 2000, Group: 2000},
+			"data1":         {Name: "data1", User: 2000, Group: 2000, MountType: "tmpfs"},
+		},
+		},
+		{
+			"mount-selector-with-path", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":       "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.mount.type": "tmpfs",
+			"com.launchplatform.oci-hooks.mount-chown.data.owner":      "2000:2000",
+		}}, map[string]ChownRequest{},
+		},
+		{
+			"missing-arg", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":  "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.owner": "2000:2000",
+			"com.launchplatform.oci-hooks.mount-chown.data":       "others",
+		}}, map[string]ChownRequest{
+			"/path/to/root": {Name: "data", Path: "/path/to/root", User: 2000, Group: 2000},
+		},
+		},
+		{
+			"acl-only", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":       "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.acl":        "u:2000:rwX,g:3000:rX",
+			"com.launchplatform.oci-hooks.mount-chown.data.defaultAcl": "g:3000:rX",
+		}}, map[string]ChownRequest{
+			"/path/to/root": {Name: "data", Path: "/path/to/root", User: -1, Group: -1, ACL: "u:2000:rwX,g:3000:rX", DefaultACL: "g:3000:rX"},
+		},
+		},
+		{
+			"invalid-acl", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path": "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.acl":  "u:postgres:rwx",
+		}}, map[string]ChownRequest{},
+		},
+		{
+			"selinux", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":           "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.selinuxLabel":   "system_u:object_r:container_file_t:s0",
+			"com.launchplatform.oci-hooks.mount-chown.data.selinuxRelabel": SELinuxRelabelShared,
+		}}, map[string]ChownRequest{
+			"/path/to/root": {
+				Name:           "data",
+				Path:           "/path/to/root",
+				User:           -1,
+				Group:          -1,
+				SELinuxLabel:   "system_u:object_r:container_file_t:s0",
+				SELinuxRelabel: SELinuxRelabelShared,
+			},
+		},
+		},
+		{
+			"invalid-selinux", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":           "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.owner":          "2000:2000",
+			"com.launchplatform.oci-hooks.mount-chown.data.selinuxLabel":   "container_file_t",
+			"com.launchplatform.oci-hooks.mount-chown.data.selinuxRelabel": "yes",
+		}}, map[string]ChownRequest{
+			"/path/to/root": {Name: "data", Path: "/path/to/root", User: 2000, Group: 2000},
+		},
+		},
+		{
+			"xattr", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.bin.path":                "/usr/bin/server",
+			"com.launchplatform.oci-hooks.mount-chown.bin.xattr.user.checksum": "0xff00",
+			"com.launchplatform.oci-hooks.mount-chown.bin.xattr.user.origin":   XattrRemove,
+			"com.launchplatform.oci-hooks.mount-chown.bin.fcaps":               "cap_net_bind_service+ep",
+		}}, map[string]ChownRequest{
+			"/usr/bin/server": {
+				Name:   "bin",
+				Path:   "/usr/bin/server",
+				User:   -1,
+				Group:  -1,
+				Xattrs: map[string]string{"user.checksum": "0xff00", "user.origin": XattrRemove},
+				FCaps:  "cap_net_bind_service+ep",
+			},
+		},
+		},
+		{
+			"invalid-xattr", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.bin.path":            "/usr/bin/server",
+			"com.launchplatform.oci-hooks.mount-chown.bin.xattr.checksum":  "value",
+			"com.launchplatform.oci-hooks.mount-chown.bin.xattr.user.data": "0xzz",
+			"com.launchplatform.oci-hooks.mount-chown.bin.fcaps":           "cap_fly+ep",
+		}}, map[string]ChownRequest{},
+		},
+		{
+			"reserved-xattr", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.bin.path":                          "/usr/bin/server",
+			"com.launchplatform.oci-hooks.mount-chown.bin.xattr.security.capability":     "0x01000002",
+			"com.launchplatform.oci-hooks.mount-chown.bin.xattr.system.posix_acl_access": "0x02000000",
+			"com.launchplatform.oci-hooks.mount-chown.bin.xattr.trusted.overlay.opaque":  "y",
+		}}, map[string]ChownRequest{},
+		},
+		{
+			"stage", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":  "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.owner": "2000:2000",
+			"com.launchplatform.oci-hooks.mount-chown.data.stage": "createRuntime, poststop",
+		}}, map[string]ChownRequest{
+			"/path/to/root": {
+				Name:   "data",
+				Path:   "/path/to/root",
+				User:   2000,
+				Group:  2000,
+				Stages: []string{StageCreateRuntime, StagePoststop},
+			},
+		},
+		},
+		{
+			"invalid-stage", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":  "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.owner": "2000:2000",
+			"com.launchplatform.oci-hooks.mount-chown.data.stage": "poststart",
+		}}, map[string]ChownRequest{
+			"/path/to/root": {Name: "data", Path: "/path/to/root", User: 2000, Group: 2000},
+		},
+		},
 		{
 			"multiple", args{annotations: map[string]string{
 			"com.launchplatform.oci-hooks.mount-chown.data0.path":  "/path/to/root0",
@@ -142,13 +504,94 @@ func Test_parseChownRequests(t *testing.T) {
 		{
 			"invalid-owner", args{annotations: map[string]string{
 			"com.launchplatform.oci-hooks.mount-chown.data.path":  "/path/to/root",
-			"com.launchplatform.oci-hooks.mount-chown.data.owner": "foobar",
+			"com.launchplatform.oci-hooks.mount-chown.data.owner": "foo:bar:baz",
+		}}, map[string]ChownRequest{},
+		},
+		{
+			"negative-owner", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":  "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.owner": "-1:2000",
 		}}, map[string]ChownRequest{},
 		},
+		{
+			"process-owner", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":  "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.owner": OwnerProcess,
+		}}, map[string]ChownRequest{
+			"/path/to/root": {Name: "data", Path: "/path/to/root", User: -1, Group: -1, ProcessOwner: true},
+		},
+		},
+		{
+			"mount-options-owner", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":  "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.owner": OwnerMountOptions,
+		}}, map[string]ChownRequest{
+			"/path/to/root": {Name: "data", Path: "/path/to/root", User: -1, Group: -1, MountOptionsOwner: true},
+		},
+		},
+		{
+			"default-process-owner", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path": "/path/to/root",
+		}, defaultOwner: OwnerProcess}, map[string]ChownRequest{
+			"/path/to/root": {Name: "data", Path: "/path/to/root", User: -1, Group: -1, ProcessOwner: true},
+		},
+		},
+		{
+			"default-numeric-owner", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path": "/path/to/root",
+		}, defaultOwner: "2000:3000"}, map[string]ChownRequest{
+			"/path/to/root": {Name: "data", Path: "/path/to/root", User: 2000, Group: 3000},
+		},
+		},
+		{
+			"default-owner-not-for-others", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path": "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.acl":  "u:2000:rwX",
+			"com.launchplatform.oci-hooks.mount-chown.bin.path":  "/usr/bin/server",
+			"com.launchplatform.oci-hooks.mount-chown.bin.fcaps": "cap_net_bind_service=+ep",
+			"com.launchplatform.oci-hooks.mount-chown.conf.path": "/etc/app",
+			"com.launchplatform.oci-hooks.mount-chown.conf.mode": "700",
+		}, defaultOwner: OwnerProcess}, map[string]ChownRequest{
+			"/path/to/root":   {Name: "data", Path: "/path/to/root", User: -1, Group: -1, ACL: "u:2000:rwX"},
+			"/usr/bin/server": {Name: "bin", Path: "/usr/bin/server", User: -1, Group: -1, FCaps: "cap_net_bind_service=+ep"},
+			"/etc/app":        {Name: "conf", Path: "/etc/app", User: -1, Group: -1, Mode: 0o700},
+		},
+		},
+		{
+			"default-owner-not-override", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":  "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.owner": "2000:2000",
+		}, defaultOwner: OwnerProcess}, map[string]ChownRequest{
+			"/path/to/root": {Name: "data", Path: "/path/to/root", User: 2000, Group: 2000},
+		},
+		},
+		{
+			"user-name", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":  "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.owner": "postgres",
+		}}, map[string]ChownRequest{
+			"/path/to/root": {Name: "data", Path: "/path/to/root", User: -1, Group: -1, UserName: "postgres"},
+		},
+		},
+		{
+			"user-and-group-name", args{annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":  "/path/to/root",
+			"com.launchplatform.oci-hooks.mount-chown.data.owner": "www-data:shared",
+		}}, map[string]ChownRequest{
+			"/path/to/root": {
+				Name:      "data",
+				Path:      "/path/to/root",
+				User:      -1,
+				Group:     -1,
+				UserName:  "www-data",
+				GroupName: "shared",
+			},
+		},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := parseChownRequests(tt.args.annotations); !reflect.DeepEqual(got, tt.want) {
+			if got := parseChownRequests(tt.args.annotations, tt.args.defaultOwner); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("parseChownRequests() = %v, want %v", got, tt.want)
 			}
 		})
@@ -196,3 +639,126 @@ func Test_parseOwner(t *testing.T) {
 		})
 	}
 }
+
+func Test_parseOwnerNames(t *testing.T) {
+	type args struct {
+		owner string
+	}
+	tests := []struct {
+		name      string
+		args      args
+		userName  string
+		groupName string
+		wantErr   assert.ErrorAssertionFunc
+	}{
+		{
+			"only-user", args{"postgres"}, "postgres", "", assert.NoError,
+		},
+		{
+			"both", args{"www-data:shared"}, "www-data", "shared", assert.NoError,
+		},
+		{
+			"mixed", args{"2000:shared"}, "2000", "shared", assert.NoError,
+		},
+		{
+			"empty", args{""}, "", "", assert.Error,
+		},
+		{
+			"empty-user", args{":shared"}, "", "", assert.Error,
+		},
+		{
+			"empty-group", args{"postgres:"}, "", "", assert.Error,
+		},
+		{
+			"more-than-two-parts", args{"a:b:c"}, "", "", assert.Error,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, got1, err := parseOwnerNames(tt.args.owner)
+			if !tt.wantErr(t, err, fmt.Sprintf("parseOwnerNames(%v)", tt.args.owner)) {
+				return
+			}
+			assert.Equalf(t, tt.userName, got, "parseOwnerNames(%v)", tt.args.owner)
+			assert.Equalf(t, tt.groupName, got1, "parseOwnerNames(%v)", tt.args.owner)
+		})
+	}
+}
+
+func Test_parseFrom(t *testing.T) {
+	type args struct {
+		from string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		uid     int
+		gid     int
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{
+			"only-user", args{"2000"}, 2000, -1, assert.NoError,
+		},
+		{
+			"only-user-with-colon", args{"2000:"}, 2000, -1, assert.NoError,
+		},
+		{
+			"only-group", args{":3000"}, -1, 3000, assert.NoError,
+		},
+		{
+			"both", args{"2000:3000"}, 2000, 3000, assert.NoError,
+		},
+		{
+			"empty", args{""}, 0, 0, assert.Error,
+		},
+		{
+			"only-colon", args{":"}, 0, 0, assert.Error,
+		},
+		{
+			"negative", args{"-1:3000"}, 0, 0, assert.Error,
+		},
+		{
+			"more-than-two-parts", args{"1:2:3"}, 0, 0, assert.Error,
+		},
+		{
+			"non-int", args{"user:group"}, 0, 0, assert.Error,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, got1, err := parseFrom(tt.args.from)
+			if !tt.wantErr(t, err, fmt.Sprintf("parseFrom(%v)", tt.args.from)) {
+				return
+			}
+			assert.Equalf(t, tt.uid, got, "parseFrom(%v)", tt.args.from)
+			assert.Equalf(t, tt.gid, got1, "parseFrom(%v)", tt.args.from)
+		})
+	}
+}
+
+func Test_filterRequestsByStage(t *testing.T) {
+	requests := map[string]ChownRequest{
+		"/default":  {Name: "default", Path: "/default"},
+		"/runtime":  {Name: "runtime", Path: "/runtime", Stages: []string{StageCreateRuntime}},
+		"/multiple": {Name: "multiple", Path: "/multiple", Stages: []string{StageCreateContainer, StagePoststop}},
+	}
+	tests := []struct {
+		name  string
+		stage string
+		want  []string
+	}{
+		{"create-container", StageCreateContainer, []string{"/default", "/multiple"}},
+		{"create-runtime", StageCreateRuntime, []string{"/runtime"}},
+		{"poststop", StagePoststop, []string{"/multiple"}},
+		{"start-container", StageStartContainer, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for key := range filterRequestsByStage(requests, tt.stage) {
+				got = append(got, key)
+			}
+			assert.ElementsMatchf(t, tt.want, got, "filterRequestsByStage(%v)", tt.stage)
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	spec "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Container holds the information of the container needed for performing the chown requests
+type Container struct {
+	// The root path of the container
+	Root string
+	// The user namespace uid mappings from the container to the host
+	UIDMappings []spec.LinuxIDMapping
+	// The user namespace gid mappings from the container to the host
+	GIDMappings []spec.LinuxIDMapping
+	// The user of the container's process
+	ProcessUser *spec.User
+	// The mounts of the container
+	Mounts []spec.Mount
+	// The SELinux context for the mounts of the container
+	MountLabel string
+}
+
+// newContainer creates the container from the spec in the bundle directory, a relative root path in the spec is
+// resolved against the bundle directory
+func newContainer(bundle string, containerSpec spec.Spec) Container {
+	container := Container{Mounts: containerSpec.Mounts}
+	if containerSpec.Root != nil {
+		container.Root = containerSpec.Root.Path
+		if !path.IsAbs(container.Root) {
+			container.Root = path.Join(bundle, container.Root)
+		}
+	}
+	if containerSpec.Process != nil {
+		processUser := containerSpec.Process.User
+		container.ProcessUser = &processUser
+	}
+	if containerSpec.Linux != nil {
+		container.UIDMappings = containerSpec.Linux.UIDMappings
+		container.GIDMappings = containerSpec.Linux.GIDMappings
+		container.MountLabel = containerSpec.Linux.MountLabel
+	}
+	return container
+}
+
+// mapID maps the given id inside the container to the id on the host with the user namespace mappings.
+// If there's no mapping at all, the id is returned as it is.
+func mapID(mappings []spec.LinuxIDMapping, id int) (int, error) {
+	if len(mappings) == 0 {
+		return id, nil
+	}
+	for _, mapping := range mappings {
+		start := int64(mapping.ContainerID)
+		end := start + int64(mapping.Size)
+		if int64(id) >= start && int64(id) < end {
+			return int(int64(mapping.HostID) + int64(id) - start), nil
+		}
+	}
+	return 0, fmt.Errorf("ID %d is out of the mapped ranges of the container's user namespace", id)
+}
+
+// mapOwner maps the given uid and gid inside the container to the ones on the host, a negative uid or gid means
+// leaving it unchanged and it is returned as it is
+func (container Container) mapOwner(uid int, gid int) (int, int, error) {
+	hostUID, hostGID := uid, gid
+	var err error
+	if uid >= 0 {
+		hostUID, err = mapID(container.UIDMappings, uid)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Failed to map uid with error: %w", err)
+		}
+	}
+	if gid >= 0 {
+		hostGID, err = mapID(container.GIDMappings, gid)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Failed to map gid with error: %w", err)
+		}
+	}
+	return hostUID, hostGID, nil
+}
+
+// findMount returns the mount with the destination containing the given path, the deepest one is returned if there
+// are nested mounts
+func (container Container) findMount(filePath string) *spec.Mount {
+	filePath = path.Clean(filePath)
+	var found *spec.Mount
+	for index, mount := range container.Mounts {
+		destination := path.Clean(mount.Destination)
+		if destination != "/" && filePath != destination && !strings.HasPrefix(filePath, destination+"/") {
+			continue
+		}
+		if found == nil || len(destination) > len(path.Clean(found.Destination)) {
+			found = &container.Mounts[index]
+		}
+	}
+	return found
+}
+
+// findMountOf returns the mount the file opened under the container root is on, by comparing its mount id with the
+// ones of the mount destinations resolved inside the container root. Unlike findMount, symlinks cannot fool it, as the
+// file is already resolved. The destinations not mounted yet are ignored, as they're on the same mount as the root.
+func (container Container) findMountOf(target *os.File) (*spec.Mount, error) {
+	targetID, err := mountID(target)
+	if err != nil {
+		return nil, err
+	}
+	root, err := resolveInRoot(container.Root, "/")
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	rootID, err := mountID(root)
+	if err != nil {
+		return nil, err
+	}
+	for index, mount := range container.Mounts {
+		// The runtime follows the symlinks of the destination when mounting
+		destination, err := openat2InRoot(container.Root, mount.Destination, unix.O_PATH)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		destinationID, err := mountID(destination)
+		destination.Close()
+		if err != nil {
+			return nil, err
+		}
+		if destinationID != rootID && destinationID == targetID {
+			return &container.Mounts[index], nil
+		}
+	}
+	return nil, nil
+}
+
+// selectMounts returns the mounts matching the given source and type, an empty value matches any. The source matches
+// either the exact source path of a mount, or any segment of it, such as the volume name in
+// /var/lib/containers/storage/volumes/<name>/_data.
+func (container Container) selectMounts(source string, mountType string) []spec.Mount {
+	var mounts []spec.Mount
+	for _, mount := range container.Mounts {
+		if mountType != "" && mount.Type != mountType {
+			continue
+		}
+		if source != "" && !matchMountSource(source, mount.Source) {
+			continue
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts
+}
+
+func matchMountSource(source string, mountSource string) bool {
+	if path.IsAbs(source) {
+		return path.Clean(source) == path.Clean(mountSource)
+	}
+	for _, segment := range strings.Split(mountSource, "/") {
+		if segment == source {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMountOptionsOwner parses the uid, gid and mode options of the mount, such as the ones of tmpfs. The omitted
+// uid or gid is returned as -1 and the omitted mode is returned as 0.
+func parseMountOptionsOwner(mount spec.Mount) (int, int, os.FileMode, error) {
+	uid, gid := -1, -1
+	var mode os.FileMode
+	found := false
+	for _, option := range mount.Options {
+		key, value, ok := strings.Cut(option, "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "uid", "gid":
+			id, err := strconv.Atoi(value)
+			if err != nil || id < 0 {
+				return 0, 0, 0, fmt.Errorf("Invalid %s option %s of mount %s", key, value, mount.Destination)
+			}
+			if key == "uid" {
+				uid = id
+			} else {
+				gid = id
+			}
+		case "mode":
+			parsedMode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || parsedMode > 0o7777 {
+				return 0, 0, 0, fmt.Errorf("Invalid mode option %s of mount %s", value, mount.Destination)
+			}
+			mode = unixMode(uint32(parsedMode))
+		default:
+			continue
+		}
+		found = true
+	}
+	if !found {
+		return 0, 0, 0, fmt.Errorf("No uid, gid or mode option found for mount %s", mount.Destination)
+	}
+	return uid, gid, mode, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	spec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func Test_mapID(t *testing.T) {
+	mappings := []spec.LinuxIDMapping{
+		{ContainerID: 0, HostID: 1000, Size: 1},
+		{ContainerID: 1, HostID: 100000, Size: 65536},
+	}
+	type args struct {
+		mappings []spec.LinuxIDMapping
+		id       int
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    int
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{"no-mappings", args{nil, 2000}, 2000, assert.NoError},
+		{"root", args{mappings, 0}, 1000, assert.NoError},
+		{"first-of-range", args{mappings, 1}, 100000, assert.NoError},
+		{"in-range", args{mappings, 2000}, 101999, assert.NoError},
+		{"last-of-range", args{mappings, 65536}, 165535, assert.NoError},
+		{"out-of-range", args{mappings, 65537}, 0, assert.Error},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mapID(tt.args.mappings, tt.args.id)
+			if !tt.wantErr(t, err, fmt.Sprintf("mapID(%v, %v)", tt.args.mappings, tt.args.id)) {
+				return
+			}
+			assert.Equalf(t, tt.want, got, "mapID(%v, %v)", tt.args.mappings, tt.args.id)
+		})
+	}
+}
+
+func Test_newContainer(t *testing.T) {
+	uidMappings := []spec.LinuxIDMapping{{ContainerID: 0, HostID: 1000, Size: 1}}
+	gidMappings := []spec.LinuxIDMapping{{ContainerID: 0, HostID: 2000, Size: 1}}
+	container := newContainer("/path/to/bundle", spec.Spec{
+		Root:    &spec.Root{Path: "/path/to/rootfs"},
+		Process: &spec.Process{User: spec.User{UID: 2000, GID: 3000}},
+		Linux: &spec.Linux{
+			UIDMappings: uidMappings,
+			GIDMappings: gidMappings,
+			MountLabel:  "system_u:object_r:container_file_t:s0:c1,c2",
+		},
+	})
+	assert.Equal(t, Container{
+		Root:        "/path/to/rootfs",
+		UIDMappings: uidMappings,
+		GIDMappings: gidMappings,
+		ProcessUser: &spec.User{UID: 2000, GID: 3000},
+		MountLabel:  "system_u:object_r:container_file_t:s0:c1,c2",
+	}, container)
+
+	// The root path generated by `runc spec` is relative to the bundle
+	container = newContainer("/path/to/bundle", spec.Spec{Root: &spec.Root{Path: "rootfs"}})
+	assert.Equal(t, "/path/to/bundle/rootfs", container.Root)
+}
+
+func Test_findMount(t *testing.T) {
+	container := Container{Mounts: []spec.Mount{
+		{Destination: "/proc", Type: "proc", Source: "proc"},
+		{Destination: "/data", Type: "bind", Source: "/mnt/data"},
+		{Destination: "/data/cache/", Type: "tmpfs", Source: "tmpfs"},
+	}}
+	tests := []struct {
+		name     string
+		filePath string
+		want     string
+	}{
+		{"mount-point", "/data", "/data"},
+		{"under-mount", "/data/tenant/file.txt", "/data"},
+		{"nested-mount", "/data/cache/file.txt", "/data/cache/"},
+		{"unclean-path", "/data/../data/cache", "/data/cache/"},
+		{"sibling-prefix", "/database", ""},
+		{"not-mounted", "/etc/passwd", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mount := container.findMount(tt.filePath)
+			if tt.want == "" {
+				assert.Nilf(t, mount, "findMount(%v)", tt.filePath)
+				return
+			}
+			if assert.NotNilf(t, mount, "findMount(%v)", tt.filePath) {
+				assert.Equalf(t, tt.want, mount.Destination, "findMount(%v)", tt.filePath)
+			}
+		})
+	}
+}
+
+func Test_selectMounts(t *testing.T) {
+	container := Container{Mounts: []spec.Mount{
+		{Destination: "/proc", Type: "proc", Source: "proc"},
+		{Destination: "/data", Type: "bind", Source: "/var/lib/containers/storage/volumes/dataset/_data"},
+		{Destination: "/tmp", Type: "tmpfs", Source: "tmpfs"},
+		{Destination: "/cache", Type: "tmpfs", Source: "tmpfs"},
+	}}
+	tests := []struct {
+		name      string
+		source    string
+		mountType string
+		want      []string
+	}{
+		{"by-type", "", "tmpfs", []string{"/tmp", "/cache"}},
+		{"by-volume-name", "dataset", "", []string{"/data"}},
+		{"by-source-path", "/var/lib/containers/storage/volumes/dataset/_data/", "", []string{"/data"}},
+		{"by-source-and-type", "dataset", "bind", []string{"/data"}},
+		{"type-mismatch", "dataset", "tmpfs", nil},
+		{"partial-segment", "data", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var destinations []string
+			for _, mount := range container.selectMounts(tt.source, tt.mountType) {
+				destinations = append(destinations, mount.Destination)
+			}
+			assert.Equalf(t, tt.want, destinations, "selectMounts(%v, %v)", tt.source, tt.mountType)
+		})
+	}
+}
+
+func Test_parseMountOptionsOwner(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []string
+		uid     int
+		gid     int
+		mode    os.FileMode
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{"all", []string{"rw", "uid=2000", "gid=3000", "mode=1777"}, 2000, 3000, os.ModeSticky | 0o777, assert.NoError},
+		{"only-gid", []string{"gid=3000"}, -1, 3000, 0, assert.NoError},
+		{"only-mode", []string{"nosuid", "mode=755"}, -1, -1, 0o755, assert.NoError},
+		{"no-options", []string{"rw", "nosuid"}, 0, 0, 0, assert.Error},
+		{"invalid-uid", []string{"uid=user"}, 0, 0, 0, assert.Error},
+		{"invalid-mode", []string{"mode=999"}, 0, 0, 0, assert.Error},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uid, gid, mode, err := parseMountOptionsOwner(spec.Mount{Destination: "/data", Options: tt.options})
+			if !tt.wantErr(t, err, fmt.Sprintf("parseMountOptionsOwner(%v)", tt.options)) {
+				return
+			}
+			assert.Equalf(t, tt.uid, uid, "parseMountOptionsOwner(%v)", tt.options)
+			assert.Equalf(t, tt.gid, gid, "parseMountOptionsOwner(%v)", tt.options)
+			assert.Equalf(t, tt.mode, mode, "parseMountOptionsOwner(%v)", tt.options)
+		})
+	}
+}
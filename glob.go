@@ -0,0 +1,66 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// validateGlob checks if the glob pattern is valid
+func validateGlob(pattern string) error {
+	for _, segment := range strings.Split(pattern, "/") {
+		if segment == "**" {
+			continue
+		}
+		_, err := path.Match(segment, "")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchGlob reports whether the relative path matches the glob pattern. The pattern is matched against each of the
+// path segments with the syntax of path.Match, plus a "**" segment matching zero or more segments. A pattern without
+// any slash matches the base name at any depth, such as ".git", while a pattern with slash is anchored to the root,
+// such as "cache/**".
+func matchGlob(pattern string, relPath string) bool {
+	pattern = strings.Trim(pattern, "/")
+	if !strings.Contains(pattern, "/") {
+		pattern = "**/" + pattern
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(relPath, "/"))
+}
+
+func matchSegments(patterns []string, segments []string) bool {
+	for len(patterns) > 0 {
+		if patterns[0] == "**" {
+			// Try to match the rest of the patterns with every possible suffix of segments
+			for i := 0; i <= len(segments); i++ {
+				if matchSegments(patterns[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		matched, err := path.Match(patterns[0], segments[0])
+		if err != nil || !matched {
+			return false
+		}
+		patterns = patterns[1:]
+		segments = segments[1:]
+	}
+	return len(segments) == 0
+}
+
+// matchAnyGlob reports whether the relative path matches any of the glob patterns
+func matchAnyGlob(patterns []string, relPath string) bool {
+	for _, pattern := range patterns {
+		if matchGlob(pattern, relPath) {
+			return true
+		}
+	}
+	return false
+}
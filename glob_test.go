@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_matchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		relPath string
+		want    bool
+	}{
+		{".git", ".git", true},
+		{".git", "project/.git", true},
+		{".git", "project/.github", false},
+		{"*.sock", "run/app.sock", true},
+		{"**/*.sock", "app.sock", true},
+		{"**/*.sock", "run/nested/app.sock", true},
+		{"**/*.sock", "run/app.socket", false},
+		{"cache/**", "cache", true},
+		{"cache/**", "cache/nested/file.txt", true},
+		{"cache/**", "data/cache/file.txt", false},
+		{"/cache", "cache", true},
+		{"data/*/tmp", "data/tenant/tmp", true},
+		{"data/*/tmp", "data/tenant/nested/tmp", false},
+		{"data/**/tmp", "data/tenant/nested/tmp", true},
+		{"data/**/tmp", "data/tmp", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+"-"+tt.relPath, func(t *testing.T) {
+			assert.Equalf(t, tt.want, matchGlob(tt.pattern, tt.relPath), "matchGlob(%v, %v)", tt.pattern, tt.relPath)
+		})
+	}
+}
+
+func Test_validateGlob(t *testing.T) {
+	assert.NoError(t, validateGlob("cache/**/*.txt"))
+	assert.Error(t, validateGlob("cache/[a-"))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// journalEntry is the original owner and mode of a file before it's changed
+type journalEntry struct {
+	// The path of the file inside the container root
+	Path string `json:"path"`
+	// The device and inode numbers identifying the file, so that a file replaced at the path is not restored
+	Dev  uint64      `json:"dev"`
+	Ino  uint64      `json:"ino"`
+	UID  int         `json:"uid"`
+	GID  int         `json:"gid"`
+	Mode os.FileMode `json:"mode"`
+}
+
+// journal records the original owner and mode of the changed files, so that they can be restored later. All the
+// methods are safe for concurrent calls, and a nil journal records nothing.
+type journal struct {
+	// The root path of the container
+	root    string
+	lock    sync.Mutex
+	entries []journalEntry
+}
+
+func newJournal(root string) *journal {
+	return &journal{root: path.Clean(root)}
+}
+
+// record records the original owner and mode of the file opened under the container root before changing it
+func (j *journal) record(target *os.File, file os.FileInfo) {
+	if j == nil {
+		return
+	}
+	filePath := "/" + strings.TrimLeft(strings.TrimPrefix(target.Name(), j.root), "/")
+	stat := file.Sys().(*syscall.Stat_t)
+	entry := journalEntry{
+		Path: filePath,
+		Dev:  uint64(stat.Dev),
+		Ino:  uint64(stat.Ino),
+		UID:  int(stat.Uid),
+		GID:  int(stat.Gid),
+		Mode: file.Mode() & modeMask,
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.entries = append(j.entries, entry)
+}
+
+// loadJournalEntries loads the journal entries from the file, it returns nil if the file doesn't exist
+func loadJournalEntries(journalPath string) ([]journalEntry, error) {
+	data, err := os.ReadFile(journalPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []journalEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// save appends the recorded entries to the journal file, so that the original state recorded by a previous run is
+// kept. The file is replaced atomically, and nothing is written if there's no entry recorded.
+func (j *journal) save(journalPath string) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if len(j.entries) == 0 {
+		return nil
+	}
+	entries, err := loadJournalEntries(journalPath)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(append(entries, j.entries...))
+	if err != nil {
+		return err
+	}
+	tempFile, err := os.CreateTemp(filepath.Dir(journalPath), "."+filepath.Base(journalPath))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.Write(data)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	closeErr := tempFile.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(tempFile.Name(), journalPath)
+}
+
+// restoreJournal restores the owner and mode of the files recorded in the journal file in reverse order, so that the
+// earliest recorded state of a file wins. Files removed or replaced since then are skipped. The journal file is removed once all
+// the entries are restored.
+func restoreJournal(containerRoot string, journalPath string) error {
+	entries, err := loadJournalEntries(journalPath)
+	if err != nil {
+		return err
+	}
+	if entries == nil {
+		log.Infof("No journal found at %s, skip restoring", journalPath)
+		return nil
+	}
+	var restoreErr error
+	for index := len(entries) - 1; index >= 0; index-- {
+		entry := entries[index]
+		err := restoreJournalEntry(containerRoot, entry)
+		if err != nil {
+			log.Errorf("Failed to restore %s with error %s", entry.Path, err)
+			restoreErr = err
+		}
+	}
+	if restoreErr != nil {
+		return restoreErr
+	}
+	log.Infof("Restored %d journal entries from %s", len(entries), journalPath)
+	return os.Remove(journalPath)
+}
+
+func restoreJournalEntry(containerRoot string, entry journalEntry) error {
+	target, err := resolveInRoot(containerRoot, path.Clean(entry.Path))
+	if errors.Is(err, os.ErrNotExist) {
+		log.Warnf("The file %s is removed, skip restoring", entry.Path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	file, err := target.Stat()
+	if err != nil {
+		return err
+	}
+	stat := file.Sys().(*syscall.Stat_t)
+	if uint64(stat.Dev) != entry.Dev || uint64(stat.Ino) != entry.Ino {
+		// The file could be replaced by the container, such as with a setuid binary of its own
+		log.Warnf("The file %s is replaced, skip restoring", entry.Path)
+		return nil
+	}
+	if !ownerMatches(file, entry.UID, entry.GID) {
+		err = fchown(target, entry.UID, entry.GID)
+		if err != nil {
+			return err
+		}
+	}
+	// Changing the owner could clear the setuid and setgid bits, so the mode is always restored after it
+	if file.Mode()&os.ModeSymlink == 0 {
+		err = fchmod(target, entry.Mode)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
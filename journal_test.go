@@ -0,0 +1,98 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+)
+
+func Test_journal(t *testing.T) {
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataDir := path.Join(rootDir, "data")
+	err = os.MkdirAll(path.Join(dataDir, "dir"), 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path.Join(dataDir, "dir", "file.txt"), []byte("MOCK_CONTENT"), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fileName := range []string{"removed.txt", "replaced.txt"} {
+		err = os.WriteFile(path.Join(dataDir, fileName), []byte("MOCK_CONTENT"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	bundleDir, err := os.MkdirTemp("", "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	journalPath := path.Join(bundleDir, journalFileName)
+
+	// Get current ownership
+	f, err := os.Lstat(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentUID := int(f.Sys().(*syscall.Stat_t).Uid)
+	currentGID := int(f.Sys().(*syscall.Stat_t).Gid)
+	dataDev := uint64(f.Sys().(*syscall.Stat_t).Dev)
+	dataIno := uint64(f.Sys().(*syscall.Stat_t).Ino)
+
+	defer func() { changeJournal = nil }()
+	for _, request := range []ChownRequest{
+		{Path: "/data", User: -1, Group: -1, Mode: 0777},
+		{Path: "/data", User: currentUID, Group: currentGID, DirMode: 0700, FileMode: 0666},
+	} {
+		// Each run appends to the journal
+		changeJournal = newJournal(rootDir + "/")
+		assert.NoError(t, doChownRequest(Container{Root: rootDir}, request))
+		assert.NoError(t, changeJournal.save(journalPath))
+	}
+	entries, err := loadJournalEntries(journalPath)
+	assert.NoError(t, err)
+	assert.Equal(t, journalEntry{Path: "/data", Dev: dataDev, Ino: dataIno, UID: currentUID, GID: currentGID, Mode: 0750}, entries[0])
+	assert.Len(t, entries, 6)
+
+	err = os.Remove(path.Join(dataDir, "removed.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Simulates the container replacing a recorded file with its own one
+	replacedPath := path.Join(dataDir, "replaced.txt")
+	err = os.WriteFile(replacedPath+".new", []byte("MOCK_CONTENT"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chmod(replacedPath+".new", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(replacedPath+".new", replacedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, restoreJournal(rootDir, journalPath))
+	for filePath, expectedMode := range map[string]os.FileMode{
+		"data":              os.ModeDir | 0750,
+		"data/dir":          os.ModeDir | 0750,
+		"data/dir/file.txt": 0640,
+		"data/replaced.txt": 0755,
+	} {
+		f, err := os.Lstat(path.Join(rootDir, filePath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expectedMode, f.Mode(), filePath)
+	}
+	_, err = os.Stat(journalPath)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// Restoring without journal is a no-op
+	assert.NoError(t, restoreJournal(rootDir, journalPath))
+}
@@ -9,7 +9,7 @@ import (
 	"io"
 	"os"
 	"path"
-	"path/filepath"
+	"sort"
 	"strings"
 	"syscall"
 )
@@ -21,9 +21,27 @@ const (
 var (
 	LogLevels = []string{"trace", "debug", "info", "warn", "warning", "error", "fatal", "panic"}
 	logLevel  = defaultLogLevel
+	// The owner argument value used for requests without owner annotation
+	defaultOwner = ""
+	// The number of directories to walk in parallel for requests without concurrency annotation
+	concurrency = 1
+	// Only allow paths at or under the mount destinations in the spec
+	strictMounts = false
+	// Record the original owner and mode of the changed files for restoring them in poststop
+	recordJournal = false
+	// The directory to store the journal files, the bundle directory is used if it's empty
+	journalDir = ""
+	// The hook stage the hook is invoked in, it's detected from the status of the container state if empty
+	stage = ""
+	// Resolve the container root through the root of the container process in procfs
+	usePidRoot = false
+	// The journal of the current run, nil if not recording
+	changeJournal *journal
 )
 
-func loadSpec(stateInput io.Reader) spec.Spec {
+const journalFileName = "mount-chown-journal.json"
+
+func loadSpec(stateInput io.Reader) (spec.State, spec.Spec) {
 	var state spec.State
 	err := json.NewDecoder(stateInput).Decode(&state)
 	if err != nil {
@@ -40,89 +58,589 @@ func loadSpec(stateInput io.Reader) spec.Spec {
 	if err != nil {
 		log.Fatalf("Failed to parse OCI spec JSON file %s with error %s", configPath, err)
 	}
-	return containerSpec
+	return state, containerSpec
+}
+
+// detectStage returns the hook stage the hook is invoked in. Without the stage argument, it's detected from the status
+// of the container state. As the prestart, createRuntime and createContainer hooks are all invoked in the creating
+// status, it's detected as createContainer then.
+func detectStage(state spec.State) (string, error) {
+	if stage != "" {
+		return stage, nil
+	}
+	switch state.Status {
+	case spec.StateCreating:
+		return StageCreateContainer, nil
+	case spec.StateCreated:
+		return StageStartContainer, nil
+	case spec.StateStopped:
+		return StagePoststop, nil
+	}
+	return "", fmt.Errorf("Unable to detect the hook stage from the container status %q", state.Status)
+}
+
+// journalPath returns the path of the journal file for the container
+func journalPath(state spec.State) string {
+	if journalDir != "" {
+		return path.Join(journalDir, state.ID+".json")
+	}
+	return path.Join(state.Bundle, journalFileName)
 }
 
-func chownFile(name string, path string, file os.FileInfo, uid int, gid int) error {
+// ownerMatches returns true if the file is already owned by the given uid and gid, a negative uid or gid means leaving
+// it unchanged, so it always matches
+func ownerMatches(file os.FileInfo, uid int, gid int) bool {
 	currentUID := int(file.Sys().(*syscall.Stat_t).Uid)
 	currentGID := int(file.Sys().(*syscall.Stat_t).Gid)
-	if uid == currentUID && gid == currentGID {
-		log.Infof("The same UID and GID of %s for %s found, skip", path, name)
+	return (uid < 0 || uid == currentUID) && (gid < 0 || gid == currentGID)
+}
+
+// chownFile changes the owner of the file if it's currently owned by fromUID and fromGID and different from the given
+// uid and gid, a negative fromUID or fromGID matches any
+func chownFile(name string, target *os.File, file os.FileInfo, uid int, gid int, fromUID int, fromGID int) error {
+	if !ownerMatches(file, fromUID, fromGID) {
+		log.Debugf("The UID and GID of %s for %s don't match the from owner, skip", target.Name(), name)
+		return nil
+	}
+	if ownerMatches(file, uid, gid) {
+		log.Infof("The same UID and GID of %s for %s found, skip", target.Name(), name)
 		return nil
 	}
-	err := os.Lchown(path, uid, gid)
+	changeJournal.record(target, file)
+	err := fchown(target, uid, gid)
 	if err != nil {
-		log.Errorf("Failed to chown path %s for %s with error %s", path, name, err)
+		log.Errorf("Failed to chown path %s for %s with error %s", target.Name(), name, err)
 		return err
 	}
 	return err
 }
 
-func doChownRequest(containerRoot string, request ChownRequest) error {
+// fsGroupMode returns the mode like Kubernetes does for the fsGroup of volume, it adds read and write permission for
+// the group, adds execute permission for the group if it's a directory or the owner can execute it, and sets the
+// setgid bit for directories so that new files inherit the group
+func fsGroupMode(mode os.FileMode, isDir bool) os.FileMode {
+	mode |= 0o060
+	if isDir || mode&0o100 != 0 {
+		mode |= 0o010
+	}
+	if isDir {
+		mode |= os.ModeSetgid
+	}
+	return mode
+}
+
+// chmodFile changes the mode of the file if it's different from the current one, symlinks are skipped as their
+// mode cannot be changed
+func chmodFile(name string, target *os.File, file os.FileInfo, mode os.FileMode) error {
+	if file.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	if mode == file.Mode()&modeMask {
+		log.Debugf("The same mode of %s for %s found, skip", target.Name(), name)
+		return nil
+	}
+	changeJournal.record(target, file)
+	err := fchmod(target, mode)
+	if err != nil {
+		log.Errorf("Failed to chmod path %s for %s with error %s", target.Name(), name, err)
+		return err
+	}
+	return nil
+}
+
+// aclFile merges the ACLs into the ones of the file if they are different, symlinks are skipped as they don't have
+// ACLs
+func aclFile(name string, target *os.File, access aclSpec, defaults aclSpec) error {
+	if access == nil && defaults == nil {
+		return nil
+	}
+	// The mode could be changed by chmod before, get the latest one
+	file, err := target.Stat()
+	if err != nil {
+		log.Errorf("Failed to get stat of %s for %s with error %s", target.Name(), name, err)
+		return err
+	}
+	if file.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	changed, err := setACL(target, file, access, defaults)
+	if err != nil {
+		log.Errorf("Failed to set ACL of path %s for %s with error %s", target.Name(), name, err)
+		return err
+	}
+	if !changed {
+		log.Debugf("The same ACL of %s for %s found, skip", target.Name(), name)
+	}
+	return nil
+}
+
+// labelFile sets the SELinux context of the file if it's different from the current one
+func labelFile(name string, target *os.File, label string) error {
+	if label == "" {
+		return nil
+	}
+	currentLabel, err := getSELinuxLabel(target)
+	if err != nil {
+		log.Errorf("Failed to get SELinux label of path %s for %s with error %s", target.Name(), name, err)
+		return err
+	}
+	if currentLabel == label {
+		log.Debugf("The same SELinux label of %s for %s found, skip", target.Name(), name)
+		return nil
+	}
+	err = setSELinuxLabel(target, label)
+	if err != nil {
+		log.Errorf("Failed to set SELinux label of path %s for %s with error %s", target.Name(), name, err)
+		return err
+	}
+	return nil
+}
+
+// requestSELinuxLabel returns the SELinux context to label files with for the request, the mount label of the
+// container is used if no label is provided. It returns an empty string if no relabeling is requested.
+func requestSELinuxLabel(container Container, request ChownRequest) (string, error) {
+	if !request.hasSELinuxLabel() {
+		return "", nil
+	}
+	label := request.SELinuxLabel
+	if label == "" {
+		if container.MountLabel == "" {
+			return "", fmt.Errorf("No mount label defined in the container spec")
+		}
+		label = container.MountLabel
+	}
+	return selinuxFileLabel(label, request.SELinuxRelabel == SELinuxRelabelShared)
+}
+
+// xattrFile sets or removes the xattrs of the file in the order of their names, a nil value means removing the xattr
+func xattrFile(name string, target *os.File, xattrs map[string][]byte) error {
+	xattrNames := make([]string, 0, len(xattrs))
+	for xattrName := range xattrs {
+		xattrNames = append(xattrNames, xattrName)
+	}
+	sort.Strings(xattrNames)
+	for _, xattrName := range xattrNames {
+		var err error
+		if xattrs[xattrName] == nil {
+			err = removeXattr(target, xattrName)
+		} else {
+			err = setXattr(target, xattrName, xattrs[xattrName])
+		}
+		if err != nil {
+			log.Errorf("Failed to change xattr %s of path %s for %s with error %s", xattrName, target.Name(), name, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// requestXattrs returns the xattr values to change for the request by their names, a nil value means removing the
+// xattr. The file capabilities are encoded as the security.capability xattr, which takes precedence over the one in
+// the xattr arguments.
+func requestXattrs(container Container, request ChownRequest) (map[string][]byte, error) {
+	xattrs := map[string][]byte{}
+	for xattrName, value := range request.Xattrs {
+		if value == XattrRemove {
+			xattrs[xattrName] = nil
+			continue
+		}
+		data, err := decodeXattrValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode value of xattr %s with error: %w", xattrName, err)
+		}
+		xattrs[xattrName] = append([]byte{}, data...)
+	}
+	if request.FCaps != "" {
+		caps, err := parseFileCaps(request.FCaps)
+		if err != nil {
+			return nil, err
+		}
+		rootUID := -1
+		if len(container.UIDMappings) > 0 {
+			// Only grant the capabilities in the user namespace of the container
+			rootUID, err = mapID(container.UIDMappings, 0)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to map the root user of the container with error: %w", err)
+			}
+		}
+		xattrs[fcapsXattr] = caps.encode(rootUID)
+	}
+	return xattrs, nil
+}
+
+// parseRequestACL parses the ACL expression of the request and maps the ids in it to the ones on the host
+func parseRequestACL(container Container, expr string) (aclSpec, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	spec, err := parseACL(expr)
+	if err != nil {
+		return nil, err
+	}
+	return spec.mapIDs(container)
+}
+
+// walkFileMode returns the mode for the file in the recursive walk of the request
+func walkFileMode(request ChownRequest, symbolic requestSymbolicModes, isRoot bool, file os.FileInfo) os.FileMode {
+	mode := file.Mode() & modeMask
+	// The root path is taken care by the mode argument if it's provided
+	if !(isRoot && (request.Mode != 0 || symbolic.Mode != nil)) {
+		if file.IsDir() {
+			if request.DirMode != 0 {
+				mode = (mode &^ os.ModePerm) | request.DirMode
+			} else if symbolic.DirMode != nil {
+				mode = symbolic.DirMode.apply(mode, true)
+			}
+		} else if file.Mode().IsRegular() {
+			if request.FileMode != 0 {
+				mode = (mode &^ os.ModePerm) | request.FileMode
+			} else if symbolic.FileMode != nil {
+				mode = symbolic.FileMode.apply(mode, false)
+			}
+		}
+	}
+	if request.Policy == PolicyFSGroup {
+		mode = fsGroupMode(mode, file.IsDir())
+	}
+	return mode
+}
+
+// createRequestPath creates the path of the request with its parents if it doesn't exist
+func createRequestPath(container Container, request ChownRequest) error {
+	// The parents are owned by the root of the container by default
+	parentUID, parentGID := 0, 0
+	var err error
+	if request.ParentOwner != "" {
+		parentUID, parentGID, err = parseOwner(request.ParentOwner)
+		if err != nil {
+			return err
+		}
+	}
+	parentUID, parentGID, err = container.mapOwner(parentUID, parentGID)
+	if err != nil {
+		return err
+	}
+	isDir := request.Create == CreateDir
+	mode := request.Mode
+	if mode == 0 {
+		mode = 0o644
+		if isDir {
+			mode = 0o755
+		}
+	}
+	created, err := createInRoot(container.Root, request.Path, isDir, mode, parentUID, parentGID)
+	if err != nil {
+		return err
+	}
+	if created {
+		log.Infof("Created %s %s for %s", request.Create, request.Path, request.Name)
+	} else {
+		log.Debugf("The path %s for %s exists, skip creating", request.Path, request.Name)
+	}
+	return nil
+}
+
+// checkStrictMounts returns an error if the resolved file of the request is not on any of the container's mounts
+func checkStrictMounts(container Container, request ChownRequest, target *os.File) error {
+	mount, err := container.findMountOf(target)
+	if err != nil {
+		log.Errorf("Failed to find mount of %s for %s with error %s", request.Path, request.Name, err)
+		return err
+	}
+	if mount == nil {
+		err := fmt.Errorf("Path %s is not on any of the mounts", request.Path)
+		log.Errorf("Refuse to chown for %s with error %s", request.Name, err)
+		return err
+	}
+	log.Debugf("Found mount %s for %s", mount.Destination, request.Name)
+	return nil
+}
+
+func doChownRequest(container Container, request ChownRequest) error {
 	log.Infof(
 		"Performing chown, name=%s, path=%s, user=%d, group=%d, policy=%s, mode=%d ...",
 		request.Name, request.Path, request.User, request.Group, request.Policy, request.Mode)
+	symbolic, err := request.parseSymbolicModes()
+	if err != nil {
+		log.Errorf("Failed to parse symbolic mode for %s with error %s", request.Name, err)
+		return err
+	}
+	if request.MountOptionsOwner {
+		mount := container.findMount(request.Path)
+		if mount == nil || path.Clean(mount.Destination) != path.Clean(request.Path) {
+			err := fmt.Errorf("Path %s is not a mount point", request.Path)
+			log.Errorf("Failed to use mount options owner for %s with error %s", request.Name, err)
+			return err
+		}
+		uid, gid, mode, err := parseMountOptionsOwner(*mount)
+		if err != nil {
+			log.Errorf("Failed to use mount options owner for %s with error %s", request.Name, err)
+			return err
+		}
+		request.User = uid
+		request.Group = gid
+		if request.Mode == 0 && symbolic.Mode == nil {
+			request.Mode = mode
+		}
+		log.Infof("Use mount options owner %d:%d and mode %s for %s", request.User, request.Group, request.Mode, request.Name)
+	}
+	if request.ProcessOwner {
+		if container.ProcessUser == nil {
+			err := fmt.Errorf("No process user defined in the container spec")
+			log.Errorf("Failed to use process owner for %s with error %s", request.Name, err)
+			return err
+		}
+		request.User = int(container.ProcessUser.UID)
+		request.Group = int(container.ProcessUser.GID)
+		log.Infof("Use process owner %d:%d for %s", request.User, request.Group, request.Name)
+	}
+	if request.UserName != "" || request.GroupName != "" {
+		uid, gid, err := resolveOwner(container.Root, request.UserName, request.GroupName)
+		if err != nil {
+			log.Errorf("Failed to resolve owner %s:%s for %s with error %s", request.UserName, request.GroupName, request.Name, err)
+			return err
+		}
+		log.Infof("Resolved owner %s:%s for %s to %d:%d", request.UserName, request.GroupName, request.Name, uid, gid)
+		if uid >= 0 {
+			request.User = uid
+		}
+		request.Group = gid
+	}
+	if request.User >= 0 || request.Group >= 0 {
+		hostUID, hostGID, err := container.mapOwner(request.User, request.Group)
+		if err != nil {
+			log.Errorf("Failed to map owner %d:%d for %s with error %s", request.User, request.Group, request.Name, err)
+			return err
+		}
+		if hostUID != request.User || hostGID != request.Group {
+			log.Infof("Mapped owner %d:%d for %s to %d:%d on the host", request.User, request.Group, request.Name, hostUID, hostGID)
+		}
+		request.User = hostUID
+		request.Group = hostGID
+	}
+	fromUID, fromGID := -1, -1
+	if request.From != "" {
+		fromUID, fromGID, err = parseFrom(request.From)
+		if err != nil {
+			log.Errorf("Failed to parse from owner %s for %s with error %s", request.From, request.Name, err)
+			return err
+		}
+		fromUID, fromGID, err = container.mapOwner(fromUID, fromGID)
+		if err != nil {
+			log.Errorf("Failed to map from owner %s for %s with error %s", request.From, request.Name, err)
+			return err
+		}
+	}
+	accessACL, err := parseRequestACL(container, request.ACL)
+	if err != nil {
+		log.Errorf("Failed to parse ACL %s for %s with error %s", request.ACL, request.Name, err)
+		return err
+	}
+	defaultACL, err := parseRequestACL(container, request.DefaultACL)
+	if err != nil {
+		log.Errorf("Failed to parse default ACL %s for %s with error %s", request.DefaultACL, request.Name, err)
+		return err
+	}
+	selinuxLabel, err := requestSELinuxLabel(container, request)
+	if err != nil {
+		log.Errorf("Failed to get SELinux label for %s with error %s", request.Name, err)
+		return err
+	}
+	xattrs, err := requestXattrs(container, request)
+	if err != nil {
+		log.Errorf("Failed to parse xattrs for %s with error %s", request.Name, err)
+		return err
+	}
+	if request.Create != "" {
+		if strictMounts {
+			// Check the nearest existing path before creating anything, as the missing ones are created under it
+			existing, err := resolveExistingInRoot(container.Root, request.Path)
+			if err != nil {
+				log.Errorf("Failed to resolve %s for %s with error %s", request.Path, request.Name, err)
+				return err
+			}
+			err = checkStrictMounts(container, request, existing)
+			existing.Close()
+			if err != nil {
+				return err
+			}
+		}
+		err = createRequestPath(container, request)
+		if err != nil {
+			log.Errorf("Failed to create %s %s for %s with error %s", request.Create, request.Path, request.Name, err)
+			return err
+		}
+	}
 	// In createContainer stage, the pivot_root is not called yet,
 	// so we need to chown based on the path to the container root
 	// ref: https://github.com/opencontainers/runtime-spec/blob/48415de180cf7d5168ca53a5aa27b6fcec8e4d81/config.md#createcontainer-hooks
-	chownPath := path.Join(containerRoot, strings.TrimLeft(request.Path, "/"))
+	// The path is resolved inside the container root, so that symlinks in an untrusted image cannot escape from it
+	target, err := resolveInRoot(container.Root, request.Path)
+	if err != nil {
+		log.Errorf("Failed to resolve %s for %s with error %s", request.Path, request.Name, err)
+		return err
+	}
+	defer target.Close()
+	chownPath := target.Name()
+	if strictMounts {
+		err = checkStrictMounts(container, request, target)
+		if err != nil {
+			return err
+		}
+	}
 
-	file, err := os.Lstat(chownPath)
+	file, err := target.Stat()
 	if err != nil {
 		log.Errorf("Failed to get stat of %s for %s with error %s", request.Path, request.Name, err)
 		return err
 	}
-	currentMode := file.Mode().Perm()
-	if request.Mode != 0 {
+	currentMode := file.Mode() & modeMask
+	// Check it before changing the mode of root path for the on-root-mismatch policy
+	rootMismatch := !ownerMatches(file, request.User, request.Group) ||
+		(request.Mode != 0 && currentMode != request.Mode) ||
+		(symbolic.Mode != nil && symbolic.Mode.apply(file.Mode(), file.IsDir()) != file.Mode()&modeMask) ||
+		walkFileMode(request, symbolic, true, file) != file.Mode()&modeMask
+	if !rootMismatch && request.Policy == PolicyOnRootMismatch && (accessACL != nil || defaultACL != nil) &&
+		file.Mode()&os.ModeSymlink == 0 {
+		accessData, defaultData, err := diffACL(target, file, accessACL, defaultACL)
+		if err != nil {
+			log.Errorf("Failed to get ACL of %s for %s with error %s", request.Path, request.Name, err)
+			return err
+		}
+		rootMismatch = accessData != nil || defaultData != nil
+	}
+	if !rootMismatch && request.Policy == PolicyOnRootMismatch && selinuxLabel != "" {
+		label, err := getSELinuxLabel(target)
+		if err != nil {
+			log.Errorf("Failed to get SELinux label of %s for %s with error %s", request.Path, request.Name, err)
+			return err
+		}
+		rootMismatch = label != selinuxLabel
+	}
+	if request.Policy == "" {
+		request.Policy = PolicyRecursive
+	}
+	if request.Policy == PolicyChildrenOnly {
+		log.Infof("Skip chmod of root path for %s with children-only policy", request.Name)
+	} else if request.Mode != 0 {
 		if currentMode == request.Mode {
 			log.Debugf("The same mode of %s for %s found, skip", chownPath, request.Name)
+		} else if file.Mode()&os.ModeSymlink != 0 {
+			log.Warnf("The path %s for %s is a symlink, skip chmod", chownPath, request.Name)
 		} else {
-			err := os.Chmod(chownPath, request.Mode)
+			changeJournal.record(target, file)
+			err := fchmod(target, request.Mode)
 			if err != nil {
 				log.Errorf("Failed to chown path %s for %s with error %s", chownPath, request.Name, err)
 			}
 			log.Infof("Chmod for %s done", request.Name)
 		}
+	} else if symbolic.Mode != nil {
+		chmodFile(request.Name, target, file, symbolic.Mode.apply(file.Mode(), file.IsDir()))
+		log.Infof("Chmod for %s done", request.Name)
 	} else {
 		log.Infof("Skip chmod for %s, no mode provided", request.Name)
 	}
 
-	if request.Policy == "" {
-		request.Policy = PolicyRecursive
+	options := walkOptions{
+		Concurrency: concurrency,
+		CrossMounts: request.CrossMounts,
+		Include:     request.Include,
+		Exclude:     request.Exclude,
+		MaxDepth:    request.MaxDepth,
 	}
-	if request.User >= 0 && request.Group >= 0 {
-		if request.Policy == PolicyRecursive {
-			err := filepath.Walk(chownPath, func(filePath string, file os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
-				chownFile(request.Name, filePath, file, request.User, request.Group)
-				return nil
-			})
+	if request.Concurrency > 0 {
+		options.Concurrency = request.Concurrency
+	}
+	if request.Policy == PolicyChildrenOnly {
+		options.MinDepth = 1
+		if options.MaxDepth == 0 {
+			options.MaxDepth = 1
+		}
+	}
+	walkFn := func(relPath string, target *os.File, file os.FileInfo) {
+		chownFile(request.Name, target, file, request.User, request.Group, fromUID, fromGID)
+		chmodFile(request.Name, target, file, walkFileMode(request, symbolic, relPath == ".", file))
+		aclFile(request.Name, target, accessACL, defaultACL)
+		labelFile(request.Name, target, selinuxLabel)
+	}
+	if request.User >= 0 || request.Group >= 0 || request.hasRecursiveMode() || request.hasACL() ||
+		request.hasSELinuxLabel() {
+		if request.Policy == PolicyRecursive || request.Policy == PolicyFSGroup || request.Policy == PolicyChildrenOnly {
+			err := walkFiles(target, options, walkFn)
 			if err != nil {
 				log.Errorf("Failed to chown %s recursively for %s with error %s", request.Path, request.Name, err)
 				return err
 			}
-			log.Infof("Chown for %s with recursive policy is done", request.Name)
+			log.Infof("Chown for %s with %s policy is done", request.Name, request.Policy)
 		} else if request.Policy == PolicyRootOnly {
-			err = chownFile(request.Name, chownPath, file, request.User, request.Group)
+			err = chownFile(request.Name, target, file, request.User, request.Group, fromUID, fromGID)
+			if err != nil {
+				return err
+			}
+			err = aclFile(request.Name, target, accessACL, defaultACL)
+			if err != nil {
+				return err
+			}
+			err = labelFile(request.Name, target, selinuxLabel)
 			if err != nil {
 				return err
 			}
 			log.Infof("Chown for %s with root-only policy is done", request.Name)
+		} else if request.Policy == PolicyOnRootMismatch {
+			if !rootMismatch {
+				log.Infof("The owner and mode of root path for %s match, skip recursive chown", request.Name)
+			} else {
+				err := walkFiles(target, options, walkFn)
+				if err != nil {
+					log.Errorf("Failed to chown %s recursively for %s with error %s", request.Path, request.Name, err)
+					return err
+				}
+			}
+			log.Infof("Chown for %s with on-root-mismatch policy is done", request.Name)
 		} else {
 			log.Fatalf("Unknown policy %s", request.Policy)
 		}
 	} else {
 		log.Infof("Skip chown for %s, no user and group provided", request.Name)
 	}
+	// It's done after chown, as changing the owner clears the file capabilities
+	if len(xattrs) > 0 && request.Policy == PolicyChildrenOnly {
+		log.Infof("Skip xattr of root path for %s with children-only policy", request.Name)
+	} else if len(xattrs) > 0 {
+		err = xattrFile(request.Name, target, xattrs)
+		if err != nil {
+			return err
+		}
+		log.Infof("Xattr for %s done", request.Name)
+	}
 	log.Infof("Chown %s is done", request.Name)
 	return nil
 }
 
-func chownRequests(containerRoot string, requests map[string]ChownRequest) {
+func chownRequests(container Container, requests map[string]ChownRequest) {
 	for _, request := range requests {
-		err := doChownRequest(containerRoot, request)
+		if request.hasMountSelector() {
+			mounts := container.selectMounts(request.MountSource, request.MountType)
+			if len(mounts) == 0 {
+				log.Warnf(
+					"No mount found with source %q and type %q for %s, skipped",
+					request.MountSource, request.MountType, request.Name,
+				)
+				continue
+			}
+			for _, mount := range mounts {
+				mountRequest := request
+				mountRequest.Path = path.Clean(mount.Destination)
+				log.Debugf("Selected mount %s for %s", mountRequest.Path, request.Name)
+				err := doChownRequest(container, mountRequest)
+				if err != nil {
+					continue
+				}
+			}
+			continue
+		}
+		err := doChownRequest(container, request)
 		if err != nil {
 			continue
 		}
@@ -130,17 +648,76 @@ func chownRequests(containerRoot string, requests map[string]ChownRequest) {
 }
 
 func run() {
-	containerSpec := loadSpec(os.Stdin)
-	requests := parseChownRequests(containerSpec.Annotations)
+	state, containerSpec := loadSpec(os.Stdin)
+	currentStage, err := detectStage(state)
+	if err != nil {
+		// Exiting with error could abort the container, such as for the poststart hooks invoked in running status
+		log.Warnf("%s, skipped", err)
+		return
+	}
+	log.Infof("Run in %s stage", currentStage)
+	container := newContainer(state.Bundle, containerSpec)
+	if currentStage == StageStartContainer {
+		// The startContainer hooks are invoked in the container after pivot_root
+		container.Root = "/"
+	} else if usePidRoot && currentStage == StagePoststop {
+		log.Warnf("The container process is gone in %s stage, use root path %s instead", currentStage, container.Root)
+	} else if usePidRoot {
+		root, err := procRoot(state.Pid, container.Root)
+		if err != nil {
+			log.Fatalf("Failed to resolve root through the container process with error %s", err)
+		}
+		log.Infof("Resolve root path %s through %s", container.Root, root)
+		container.Root = root
+	}
+	if currentStage == StagePoststop {
+		// Restore the original owner and mode recorded by the previous run
+		err := restoreJournal(container.Root, journalPath(state))
+		if err != nil {
+			log.Fatalf("Failed to restore journal with error %s", err)
+		}
+	}
+	requests := filterRequestsByStage(parseChownRequests(containerSpec.Annotations, defaultOwner), currentStage)
 	requestsJson, err := json.Marshal(requests)
 	if err != nil {
 		log.Fatal(err)
 	}
 	log.Infof("Parsed requests: %s", string(requestsJson))
-	chownRequests(containerSpec.Root.Path, requests)
+	// There's nothing to restore for changes made after the container stopped, and the journal can't be saved in the
+	// bundle directory from inside the container in startContainer stage
+	if recordJournal && currentStage == StageStartContainer {
+		log.Warnf("The journal is not supported in %s stage, changes are not recorded", currentStage)
+	} else if recordJournal && currentStage != StagePoststop {
+		changeJournal = newJournal(container.Root)
+	}
+	chownRequests(container, requests)
+	if changeJournal != nil {
+		err = changeJournal.save(journalPath(state))
+		if err != nil {
+			log.Fatalf("Failed to save journal with error %s", err)
+		}
+	}
 	log.Infof("Done")
 }
 
+func validateStage() {
+	if stage != "" && !isValidStage(stage) {
+		fmt.Fprintf(os.Stderr, "Stage %q is not supported, choose from: %s\n", stage, strings.Join(Stages, ", "))
+		os.Exit(1)
+	}
+}
+
+func validateDefaultOwner() {
+	if defaultOwner == "" {
+		return
+	}
+	err := parseOwnerArg(&ChownRequest{}, defaultOwner)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Default owner %q is not valid with error %s\n", defaultOwner, err)
+		os.Exit(1)
+	}
+}
+
 func setupLogLevel() {
 	var found = false
 	for _, level := range LogLevels {
@@ -166,10 +743,12 @@ func setupLogLevel() {
 func main() {
 	var rootCmd = &cobra.Command{
 		Use:     "mount_chown [options]",
-		Short:   "Invoked as a createContainer OCI-hooks to chown specific mount points",
+		Short:   "Invoked as OCI-hooks to chown specific mount points in the stages requested",
 		Version: Version,
 		Run: func(cmd *cobra.Command, args []string) {
 			setupLogLevel()
+			validateDefaultOwner()
+			validateStage()
 			log.Infof("Run mount_chown %s", Version)
 			run()
 		},
@@ -182,6 +761,48 @@ func main() {
 		logLevel,
 		fmt.Sprintf("Log messages above specified level (%s)", strings.Join(LogLevels, ", ")),
 	)
+	pFlags.IntVar(
+		&concurrency,
+		"concurrency",
+		concurrency,
+		"Number of directories to walk in parallel for recursive policies",
+	)
+	pFlags.BoolVar(
+		&strictMounts,
+		"strict-mounts",
+		strictMounts,
+		"Refuse paths which are not mount destinations in the OCI spec or under one",
+	)
+	pFlags.StringVar(
+		&stage,
+		"stage",
+		stage,
+		fmt.Sprintf("Hook stage the hook is invoked in (%s), detected from the container status by default", strings.Join(Stages, ", ")),
+	)
+	pFlags.BoolVar(
+		&usePidRoot,
+		"use-pid-root",
+		usePidRoot,
+		"Resolve paths through /proc/<pid>/root of the container process to access mounts only in its mount namespace",
+	)
+	pFlags.BoolVar(
+		&recordJournal,
+		"journal",
+		recordJournal,
+		"Record the original owner and mode of the changed files, and restore them when invoked as a poststop hook",
+	)
+	pFlags.StringVar(
+		&journalDir,
+		"journal-dir",
+		journalDir,
+		"Directory to store the journal files in, the bundle directory is used by default",
+	)
+	pFlags.StringVar(
+		&defaultOwner,
+		"default-owner",
+		defaultOwner,
+		fmt.Sprintf("Owner used for requests without owner annotation, such as %s for the container's process user", OwnerProcess),
+	)
 
 	err := rootCmd.Execute()
 	if err != nil {
@@ -6,11 +6,14 @@ import (
 	"fmt"
 	spec "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
 	"os"
+	"os/exec"
 	"path"
 	"reflect"
 	"syscall"
 	"testing"
+	"time"
 )
 
 func Test_loadSpec(t *testing.T) {
@@ -20,6 +23,7 @@ func Test_loadSpec(t *testing.T) {
 	}
 	specValue := spec.Spec{
 		Version: spec.Version,
+		Root:    &spec.Root{Path: "rootfs"},
 		Mounts: []spec.Mount{
 			{
 				Destination: "/data",
@@ -41,8 +45,131 @@ func Test_loadSpec(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	resultSpec := loadSpec(bytes.NewReader(stateData))
+	resultState, resultSpec := loadSpec(bytes.NewReader(stateData))
+	assert.Equal(t, tempDir, resultState.Bundle)
 	assert.True(t, reflect.DeepEqual(resultSpec, specValue))
+	assert.Equal(t, path.Join(tempDir, "rootfs"), newContainer(resultState.Bundle, resultSpec).Root)
+}
+
+func Test_run(t *testing.T) {
+	tests := []struct {
+		name   string
+		status spec.ContainerState
+		// The expected mode of the data dir after running
+		mode os.FileMode
+	}{
+		// The rootfs is resolved against the bundle instead of the working directory
+		{"relative-root", spec.StateCreating, os.ModeDir | 0700},
+		// The stage cannot be detected, such as for poststart hooks, nothing is changed without exiting with error
+		{"unknown-status", spec.StateRunning, os.ModeDir | 0755},
+	}
+	defer func(stdin *os.File) { os.Stdin = stdin }(os.Stdin)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bundleDir, err := os.MkdirTemp("", "bundle")
+			if err != nil {
+				t.Fatal(err)
+			}
+			dataDir := path.Join(bundleDir, "rootfs", "data")
+			err = os.MkdirAll(dataDir, 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			configData, err := json.Marshal(spec.Spec{
+				Version: spec.Version,
+				Root:    &spec.Root{Path: "rootfs"},
+				Annotations: map[string]string{
+					"com.launchplatform.oci-hooks.mount-chown.data.path": "/data",
+					"com.launchplatform.oci-hooks.mount-chown.data.mode": "700",
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.WriteFile(path.Join(bundleDir, "config.json"), configData, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stateData, err := json.Marshal(spec.State{Version: spec.Version, Status: tt.status, Bundle: bundleDir})
+			if err != nil {
+				t.Fatal(err)
+			}
+			statePath := path.Join(bundleDir, "state.json")
+			err = os.WriteFile(statePath, stateData, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stateFile, err := os.Open(statePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stateFile.Close()
+			os.Stdin = stateFile
+
+			run()
+			f, err := os.Lstat(dataDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.mode, f.Mode())
+		})
+	}
+}
+
+func Test_runWithJournalInStartContainer(t *testing.T) {
+	defer func(recordJournalValue bool) { recordJournal = recordJournalValue }(recordJournal)
+	defer func() { changeJournal = nil }()
+	defer func(stdin *os.File) { os.Stdin = stdin }(os.Stdin)
+	recordJournal = true
+	bundleDir, err := os.MkdirTemp("", "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The root is / in startContainer stage, so the data dir is given as an absolute path on the host
+	dataDir, err := os.MkdirTemp("", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configData, err := json.Marshal(spec.Spec{
+		Version: spec.Version,
+		Root:    &spec.Root{Path: "rootfs"},
+		Annotations: map[string]string{
+			"com.launchplatform.oci-hooks.mount-chown.data.path":  dataDir,
+			"com.launchplatform.oci-hooks.mount-chown.data.mode":  "750",
+			"com.launchplatform.oci-hooks.mount-chown.data.stage": StageStartContainer,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path.Join(bundleDir, "config.json"), configData, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateData, err := json.Marshal(spec.State{Version: spec.Version, Status: spec.StateCreated, Bundle: bundleDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	statePath := path.Join(bundleDir, "state.json")
+	err = os.WriteFile(statePath, stateData, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateFile, err := os.Open(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stateFile.Close()
+	os.Stdin = stateFile
+
+	run()
+	f, err := os.Lstat(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.ModeDir|0750, f.Mode())
+	// The journal file in the bundle dir is not accessible from inside the container, it should not be recorded
+	assert.NoFileExists(t, path.Join(bundleDir, journalFileName))
 }
 
 func Test_chownRequests(t *testing.T) {
@@ -78,7 +205,7 @@ func Test_chownRequests(t *testing.T) {
 	currentGID := int(f.Sys().(*syscall.Stat_t).Gid)
 
 	requests := map[string]ChownRequest{mountDir: {Path: "/data", User: currentUID, Group: currentGID, Name: "data"}}
-	chownRequests(rootDir, requests)
+	chownRequests(Container{Root: rootDir}, requests)
 	// Change own requires privilege, so it's a bit hard to assert.
 	// We set it the current uid & gid to make it easier to run for now.
 }
@@ -143,7 +270,7 @@ func Test_doChownRequest(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			tt.wantErr(t, doChownRequest(rootDir, tt.args), fmt.Sprintf("doChownRequest(%v)", tt.args))
+			tt.wantErr(t, doChownRequest(Container{Root: rootDir}, tt.args), fmt.Sprintf("doChownRequest(%v)", tt.args))
 		})
 	}
 }
@@ -182,7 +309,7 @@ func Test_doChownRequestForMode(t *testing.T) {
 	currentGID := int(f.Sys().(*syscall.Stat_t).Gid)
 
 	request := ChownRequest{Path: "/data", User: currentUID, Group: currentGID, Policy: PolicyRootOnly, Mode: 0700}
-	err = doChownRequest(rootDir, request)
+	err = doChownRequest(Container{Root: rootDir}, request)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -193,3 +320,1233 @@ func Test_doChownRequestForMode(t *testing.T) {
 	}
 	assert.Equal(t, os.FileMode(0700), f.Mode().Perm())
 }
+
+func Test_doChownRequestForOwnerNames(t *testing.T) {
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mountDir := path.Join(rootDir, "data")
+	err = os.MkdirAll(mountDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etcDir := path.Join(rootDir, "etc")
+	err = os.MkdirAll(etcDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Get mount dir info
+	f, err := os.Lstat(mountDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Get current ownership
+	currentUID := int(f.Sys().(*syscall.Stat_t).Uid)
+	currentGID := int(f.Sys().(*syscall.Stat_t).Gid)
+
+	passwdData := fmt.Sprintf("app:x:%d:%d::/home/app:/bin/sh\n", currentUID, currentGID)
+	err = os.WriteFile(path.Join(etcDir, "passwd"), []byte(passwdData), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupData := fmt.Sprintf("app:x:%d:\n", currentGID)
+	err = os.WriteFile(path.Join(etcDir, "group"), []byte(groupData), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		args    ChownRequest
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{
+			"user-name",
+			ChownRequest{Path: "/data", User: -1, Group: -1, UserName: "app"},
+			assert.NoError,
+		},
+		{
+			"user-and-group-name",
+			ChownRequest{Path: "/data", User: -1, Group: -1, UserName: "app", GroupName: "app"},
+			assert.NoError,
+		},
+		{
+			"unknown-user",
+			ChownRequest{Path: "/data", User: -1, Group: -1, UserName: "unknown"},
+			assert.Error,
+		},
+		{
+			"unknown-group",
+			ChownRequest{Path: "/data", User: -1, Group: -1, UserName: "app", GroupName: "unknown"},
+			assert.Error,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.wantErr(t, doChownRequest(Container{Root: rootDir}, tt.args), fmt.Sprintf("doChownRequest(%v)", tt.args))
+		})
+	}
+}
+
+func Test_doChownRequestForIDMappings(t *testing.T) {
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mountDir := path.Join(rootDir, "data")
+	err = os.MkdirAll(mountDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Get mount dir info
+	f, err := os.Lstat(mountDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Get current ownership
+	currentUID := uint32(f.Sys().(*syscall.Stat_t).Uid)
+	currentGID := uint32(f.Sys().(*syscall.Stat_t).Gid)
+
+	// Map 2000:3000 in the container to the current uid and gid on the host
+	container := Container{
+		Root:        rootDir,
+		UIDMappings: []spec.LinuxIDMapping{{ContainerID: 2000, HostID: currentUID, Size: 1}},
+		GIDMappings: []spec.LinuxIDMapping{{ContainerID: 3000, HostID: currentGID, Size: 1}},
+	}
+	tests := []struct {
+		name    string
+		args    ChownRequest
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{
+			"mapped",
+			ChownRequest{Path: "/data", User: 2000, Group: 3000},
+			assert.NoError,
+		},
+		{
+			"unmapped-user",
+			ChownRequest{Path: "/data", User: 2001, Group: 3000},
+			assert.Error,
+		},
+		{
+			"unmapped-group",
+			ChownRequest{Path: "/data", User: 2000, Group: 3001},
+			assert.Error,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.wantErr(t, doChownRequest(container, tt.args), fmt.Sprintf("doChownRequest(%v)", tt.args))
+		})
+	}
+}
+
+func Test_doChownRequestForProcessOwner(t *testing.T) {
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mountDir := path.Join(rootDir, "data")
+	err = os.MkdirAll(mountDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Get mount dir info
+	f, err := os.Lstat(mountDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Get current ownership
+	currentUID := f.Sys().(*syscall.Stat_t).Uid
+	currentGID := f.Sys().(*syscall.Stat_t).Gid
+
+	request := ChownRequest{Path: "/data", User: -1, Group: -1, ProcessOwner: true}
+	err = doChownRequest(
+		Container{Root: rootDir, ProcessUser: &spec.User{UID: currentUID, GID: currentGID}},
+		request,
+	)
+	assert.NoError(t, err)
+	err = doChownRequest(Container{Root: rootDir}, request)
+	assert.Error(t, err)
+}
+
+func Test_doChownRequestForFSGroup(t *testing.T) {
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mountDir := path.Join(rootDir, "data")
+	err = os.MkdirAll(mountDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nestedFileDir := path.Join(mountDir, "nested")
+	err = os.MkdirAll(nestedFileDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataFilePath := path.Join(nestedFileDir, "data.txt")
+	err = os.WriteFile(dataFilePath, []byte("MOCK_CONTENT"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	execFilePath := path.Join(nestedFileDir, "run.sh")
+	err = os.WriteFile(execFilePath, []byte("MOCK_CONTENT"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The group can search the directory even if the owner cannot
+	emptyDir := path.Join(mountDir, "empty")
+	err = os.Mkdir(emptyDir, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Get mount dir info
+	f, err := os.Lstat(mountDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Get current ownership
+	currentGID := int(f.Sys().(*syscall.Stat_t).Gid)
+
+	request := ChownRequest{
+		Path:      "/data",
+		User:      -1,
+		Group:     -1,
+		GroupName: fmt.Sprintf("%d", currentGID),
+		Policy:    PolicyFSGroup,
+	}
+	err = doChownRequest(Container{Root: rootDir}, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for filePath, expectedMode := range map[string]os.FileMode{
+		mountDir:      os.ModeDir | os.ModeSetgid | 0775,
+		nestedFileDir: os.ModeDir | os.ModeSetgid | 0770,
+		emptyDir:      os.ModeDir | os.ModeSetgid | 0670,
+		dataFilePath:  0660,
+		execFilePath:  0770,
+	} {
+		f, err = os.Lstat(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expectedMode, f.Mode(), filePath)
+		assert.Equal(t, currentGID, int(f.Sys().(*syscall.Stat_t).Gid), filePath)
+	}
+}
+
+func Test_doChownRequestForOnRootMismatch(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Changing owner to another user requires root privilege")
+	}
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mountDir := path.Join(rootDir, "data")
+	err = os.MkdirAll(mountDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nestedFilePath := path.Join(mountDir, "file.txt")
+	err = os.WriteFile(nestedFilePath, []byte("MOCK_CONTENT"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Lchown(nestedFilePath, 1234, 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := ChownRequest{Path: "/data", User: 0, Group: 0, Policy: PolicyOnRootMismatch}
+
+	// The root matches, the nested file should be left untouched
+	err = doChownRequest(Container{Root: rootDir}, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Lstat(nestedFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint32(1234), f.Sys().(*syscall.Stat_t).Uid)
+
+	// The root mismatches, the whole tree should be changed
+	err = os.Lchown(mountDir, 1234, 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = doChownRequest(Container{Root: rootDir}, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, filePath := range []string{mountDir, nestedFilePath} {
+		f, err = os.Lstat(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, uint32(0), f.Sys().(*syscall.Stat_t).Uid, filePath)
+		assert.Equal(t, uint32(0), f.Sys().(*syscall.Stat_t).Gid, filePath)
+	}
+}
+
+func Test_doChownRequestForOnRootMismatchWithSpecialBits(t *testing.T) {
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mountDir := path.Join(rootDir, "data")
+	err = os.MkdirAll(mountDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nestedFilePath := path.Join(mountDir, "file.txt")
+	err = os.WriteFile(nestedFilePath, []byte("MOCK_CONTENT"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chmod(mountDir, os.ModeSetgid|0775)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { changeJournal = nil }()
+	changeJournal = newJournal(rootDir)
+	request := ChownRequest{
+		Path:     "/data",
+		User:     -1,
+		Group:    -1,
+		Mode:     os.ModeSetgid | 0775,
+		FileMode: 0600,
+		Policy:   PolicyOnRootMismatch,
+	}
+	// The root matches with the setgid bit, nothing should be changed
+	err = doChownRequest(Container{Root: rootDir}, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, changeJournal.entries)
+	f, err := os.Lstat(nestedFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0644), f.Mode())
+
+	// The root mismatches without the setgid bit, the whole tree should be changed
+	err = os.Chmod(mountDir, 0775)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = doChownRequest(Container{Root: rootDir}, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for filePath, expectedMode := range map[string]os.FileMode{
+		mountDir:       os.ModeDir | os.ModeSetgid | 0775,
+		nestedFilePath: 0600,
+	} {
+		f, err = os.Lstat(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expectedMode, f.Mode(), filePath)
+	}
+}
+
+func Test_doChownRequestForDirAndFileMode(t *testing.T) {
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mountDir := path.Join(rootDir, "data")
+	err = os.MkdirAll(mountDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nestedFileDir := path.Join(mountDir, "nested", "dir")
+	nestedFilePath := path.Join(nestedFileDir, "file.txt")
+	err = os.MkdirAll(nestedFileDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(nestedFilePath, []byte("MOCK_CONTENT"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		args    ChownRequest
+		modes   map[string]os.FileMode
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{
+			"recursive",
+			ChownRequest{Path: "/data", User: -1, Group: -1, DirMode: 0775, FileMode: 0664},
+			map[string]os.FileMode{
+				mountDir:       os.ModeDir | 0775,
+				nestedFileDir:  os.ModeDir | 0775,
+				nestedFilePath: 0664,
+			},
+			assert.NoError,
+		},
+		{
+			"root-mode-wins",
+			ChownRequest{Path: "/data", User: -1, Group: -1, Mode: 0700, DirMode: 0755, FileMode: 0644},
+			map[string]os.FileMode{
+				mountDir:       os.ModeDir | 0700,
+				nestedFileDir:  os.ModeDir | 0755,
+				nestedFilePath: 0644,
+			},
+			assert.NoError,
+		},
+		{
+			"symbolic",
+			ChownRequest{
+				Path:             "/data",
+				User:             -1,
+				Group:            -1,
+				SymbolicMode:     "o+t",
+				SymbolicDirMode:  "g+rwX,o-rwx",
+				SymbolicFileMode: "g+rwX,o-rwx",
+			},
+			map[string]os.FileMode{
+				mountDir:       os.ModeDir | os.ModeSticky | 0700,
+				nestedFileDir:  os.ModeDir | 0770,
+				nestedFilePath: 0660,
+			},
+			assert.NoError,
+		},
+		{
+			"invalid-symbolic",
+			ChownRequest{Path: "/data", User: -1, Group: -1, SymbolicMode: "u+z"},
+			map[string]os.FileMode{},
+			assert.Error,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !tt.wantErr(t, doChownRequest(Container{Root: rootDir}, tt.args), fmt.Sprintf("doChownRequest(%v)", tt.args)) {
+				return
+			}
+			for filePath, expectedMode := range tt.modes {
+				f, err := os.Lstat(filePath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				assert.Equal(t, expectedMode, f.Mode(), filePath)
+			}
+		})
+	}
+}
+
+func Test_doChownRequestForChildrenOnly(t *testing.T) {
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mountDir := path.Join(rootDir, "data")
+	err = os.MkdirAll(mountDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenantDir := path.Join(mountDir, "tenant")
+	nestedFileDir := path.Join(tenantDir, "nested")
+	err = os.MkdirAll(nestedFileDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filePath := path.Join(mountDir, "file.txt")
+	err = os.WriteFile(filePath, []byte("MOCK_CONTENT"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chmod(tenantDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := ChownRequest{
+		Path:     "/data",
+		User:     -1,
+		Group:    -1,
+		Mode:     0700,
+		DirMode:  0750,
+		FileMode: 0640,
+		Xattrs:   map[string]string{"user.mount-chown": "value"},
+		Policy:   PolicyChildrenOnly,
+	}
+	err = doChownRequest(Container{Root: rootDir}, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for filePath, expectedMode := range map[string]os.FileMode{
+		// The root folder itself is not touched
+		mountDir:      os.ModeDir | 0755,
+		tenantDir:     os.ModeDir | 0750,
+		filePath:      0640,
+		nestedFileDir: os.ModeDir | 0700,
+	} {
+		f, err := os.Lstat(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expectedMode, f.Mode(), filePath)
+	}
+	_, err = unix.Lgetxattr(mountDir, "user.mount-chown", nil)
+	assert.ErrorIs(t, err, unix.ENODATA)
+}
+
+func Test_doChownRequestNotEscapingRoot(t *testing.T) {
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outsideDir, err := os.MkdirTemp("", "outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chmod(outsideDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(path.Join(rootDir, "data"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(outsideDir, path.Join(rootDir, "data", "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("../../../../../../.."+path.Dir(outsideDir), path.Join(rootDir, "data", "parent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		args    ChownRequest
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{
+			"last-component",
+			ChownRequest{Path: "/data/link", User: -1, Group: -1, Mode: 0777, Policy: PolicyRootOnly},
+			assert.NoError,
+		},
+		{
+			"intermediate-component",
+			ChownRequest{Path: "/data/parent/" + path.Base(outsideDir), User: -1, Group: -1, Mode: 0777},
+			assert.Error,
+		},
+		{
+			"recursive",
+			ChownRequest{Path: "/data", User: -1, Group: -1, DirMode: 0777, FileMode: 0777},
+			assert.NoError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.wantErr(t, doChownRequest(Container{Root: rootDir}, tt.args), fmt.Sprintf("doChownRequest(%v)", tt.args))
+			f, err := os.Lstat(outsideDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, os.FileMode(0700), f.Mode().Perm())
+		})
+	}
+}
+
+func Test_doChownRequestForFrom(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Changing owner to another user requires root privilege")
+	}
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mountDir := path.Join(rootDir, "data")
+	err = os.MkdirAll(mountDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binaryPath := path.Join(mountDir, "binary")
+	err = os.WriteFile(binaryPath, []byte("MOCK_CONTENT"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataPath := path.Join(mountDir, "data.txt")
+	err = os.WriteFile(dataPath, []byte("MOCK_CONTENT"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Lchown(dataPath, 1234, 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := ChownRequest{Path: "/data", User: 2000, Group: 2000, From: "1234:1234"}
+	err = doChownRequest(Container{Root: rootDir}, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for filePath, expectedOwner := range map[string]uint32{
+		mountDir:   0,
+		binaryPath: 0,
+		dataPath:   2000,
+	} {
+		f, err := os.Lstat(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expectedOwner, f.Sys().(*syscall.Stat_t).Uid, filePath)
+		assert.Equal(t, expectedOwner, f.Sys().(*syscall.Stat_t).Gid, filePath)
+	}
+}
+
+func Test_doChownRequestForCreate(t *testing.T) {
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Get root dir info
+	f, err := os.Lstat(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Get current ownership
+	currentUID := int(f.Sys().(*syscall.Stat_t).Uid)
+	currentGID := int(f.Sys().(*syscall.Stat_t).Gid)
+	parentOwner := fmt.Sprintf("%d:%d", currentUID, currentGID)
+
+	tests := []struct {
+		name    string
+		args    ChownRequest
+		modes   map[string]os.FileMode
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{
+			"dir",
+			ChownRequest{
+				Path:        "/data/tenant",
+				User:        currentUID,
+				Group:       currentGID,
+				Mode:        0770,
+				Create:      CreateDir,
+				ParentOwner: parentOwner,
+			},
+			map[string]os.FileMode{"data": os.ModeDir | 0755, "data/tenant": os.ModeDir | 0770},
+			assert.NoError,
+		},
+		{
+			"file",
+			ChownRequest{Path: "/run/app.sock", User: currentUID, Group: currentGID, Create: CreateFile, ParentOwner: parentOwner},
+			map[string]os.FileMode{"run": os.ModeDir | 0755, "run/app.sock": 0644},
+			assert.NoError,
+		},
+		{
+			"not-created",
+			ChownRequest{Path: "/tmp/file.txt", User: currentUID, Group: currentGID},
+			map[string]os.FileMode{},
+			assert.Error,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !tt.wantErr(t, doChownRequest(Container{Root: rootDir}, tt.args), fmt.Sprintf("doChownRequest(%v)", tt.args)) {
+				return
+			}
+			for filePath, expectedMode := range tt.modes {
+				f, err := os.Lstat(path.Join(rootDir, filePath))
+				if err != nil {
+					t.Fatal(err)
+				}
+				assert.Equal(t, expectedMode, f.Mode(), filePath)
+				assert.Equal(t, currentUID, int(f.Sys().(*syscall.Stat_t).Uid), filePath)
+				assert.Equal(t, currentGID, int(f.Sys().(*syscall.Stat_t).Gid), filePath)
+			}
+		})
+	}
+}
+
+func Test_doChownRequestForStrictMounts(t *testing.T) {
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"data", "etc", "cache"} {
+		err = os.Mkdir(path.Join(rootDir, dir), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mountDir := path.Join(rootDir, "data")
+	err = syscall.Mount("tmpfs", mountDir, "tmpfs", 0, "")
+	if err != nil {
+		t.Skipf("Mounting tmpfs requires privilege, error: %s", err)
+	}
+	defer syscall.Unmount(mountDir, 0)
+	err = os.WriteFile(path.Join(mountDir, "file.txt"), []byte("MOCK_CONTENT"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A symlink under the mount pointing to the container's root filesystem
+	err = os.Symlink("/etc", path.Join(mountDir, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Get root dir info
+	f, err := os.Lstat(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Get current ownership
+	currentUID := int(f.Sys().(*syscall.Stat_t).Uid)
+	currentGID := int(f.Sys().(*syscall.Stat_t).Gid)
+
+	container := Container{
+		Root: rootDir,
+		Mounts: []spec.Mount{
+			{Destination: "/data", Type: "tmpfs", Source: "tmpfs"},
+			// Not mounted yet
+			{Destination: "/cache", Type: "tmpfs", Source: "tmpfs"},
+		},
+	}
+	defer func(value bool) { strictMounts = value }(strictMounts)
+	strictMounts = true
+
+	tests := []struct {
+		name    string
+		args    ChownRequest
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{"mount-point", ChownRequest{Path: "/data", User: currentUID, Group: currentGID}, assert.NoError},
+		{"under-mount", ChownRequest{Path: "/data/file.txt", User: currentUID, Group: currentGID}, assert.NoError},
+		{"symlink", ChownRequest{Path: "/data/link", User: currentUID, Group: currentGID}, assert.NoError},
+		{"not-mounted", ChownRequest{Path: "/etc", User: currentUID, Group: currentGID}, assert.Error},
+		{"not-mounted-yet", ChownRequest{Path: "/cache", User: currentUID, Group: currentGID}, assert.Error},
+		{"escaping", ChownRequest{Path: "/data/../etc", User: currentUID, Group: currentGID}, assert.Error},
+		{"through-symlink", ChownRequest{Path: "/data/link/", User: currentUID, Group: currentGID}, assert.Error},
+		{
+			"create-through-symlink",
+			ChownRequest{Path: "/data/link/new", User: currentUID, Group: currentGID, Create: CreateDir},
+			assert.Error,
+		},
+		{
+			"create-under-mount",
+			ChownRequest{Path: "/data/new/nested", User: currentUID, Group: currentGID, Create: CreateDir},
+			assert.NoError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.wantErr(t, doChownRequest(container, tt.args), fmt.Sprintf("doChownRequest(%v)", tt.args))
+		})
+	}
+	_, err = os.Lstat(path.Join(rootDir, "etc", "new"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func Test_chownRequestsForMountSelector(t *testing.T) {
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"tmp", "cache", "data"} {
+		err = os.Mkdir(path.Join(rootDir, dir), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	container := Container{
+		Root: rootDir,
+		Mounts: []spec.Mount{
+			{Destination: "/tmp", Type: "tmpfs", Source: "tmpfs"},
+			{Destination: "/cache/", Type: "tmpfs", Source: "tmpfs"},
+			{Destination: "/data", Type: "bind", Source: "/mnt/data"},
+		},
+	}
+	requests := map[string]ChownRequest{"tmpfs": {Name: "tmpfs", User: -1, Group: -1, Mode: 0777, MountType: "tmpfs"}}
+	chownRequests(container, requests)
+	for dir, expectedMode := range map[string]os.FileMode{
+		"tmp":   os.ModeDir | 0777,
+		"cache": os.ModeDir | 0777,
+		"data":  os.ModeDir | 0755,
+	} {
+		f, err := os.Lstat(path.Join(rootDir, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expectedMode, f.Mode(), dir)
+	}
+}
+
+func Test_doChownRequestForMountOptionsOwner(t *testing.T) {
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"tmp", "data", "cache"} {
+		err = os.Mkdir(path.Join(rootDir, dir), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Get root dir info
+	f, err := os.Lstat(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Get current ownership
+	currentUID := int(f.Sys().(*syscall.Stat_t).Uid)
+	currentGID := int(f.Sys().(*syscall.Stat_t).Gid)
+
+	container := Container{
+		Root: rootDir,
+		Mounts: []spec.Mount{
+			{Destination: "/tmp", Type: "bind", Source: "/mnt/tmp", Options: []string{"rbind", "mode=1777"}},
+			{
+				Destination: "/data",
+				Type:        "bind",
+				Source:      "/mnt/data",
+				Options:     []string{fmt.Sprintf("uid=%d", currentUID), fmt.Sprintf("gid=%d", currentGID), "mode=700"},
+			},
+			{Destination: "/cache", Type: "bind", Source: "/mnt/cache", Options: []string{"rbind"}},
+		},
+	}
+	tests := []struct {
+		name    string
+		args    ChownRequest
+		mode    os.FileMode
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{
+			"mode-only",
+			ChownRequest{Path: "/tmp", User: -1, Group: -1, MountOptionsOwner: true},
+			os.ModeDir | os.ModeSticky | 0777,
+			assert.NoError,
+		},
+		{
+			"mode-annotation-precedence",
+			ChownRequest{Path: "/data", User: -1, Group: -1, Mode: 0750, MountOptionsOwner: true},
+			os.ModeDir | 0750,
+			assert.NoError,
+		},
+		{
+			"no-options",
+			ChownRequest{Path: "/cache", User: -1, Group: -1, MountOptionsOwner: true},
+			os.ModeDir | 0755,
+			assert.Error,
+		},
+		{
+			"not-mount-point",
+			ChownRequest{Path: "/data/nested", User: -1, Group: -1, MountOptionsOwner: true},
+			0,
+			assert.Error,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !tt.wantErr(t, doChownRequest(container, tt.args), fmt.Sprintf("doChownRequest(%v)", tt.args)) || tt.mode == 0 {
+				return
+			}
+			f, err := os.Lstat(path.Join(rootDir, tt.args.Path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.mode, f.Mode())
+			assert.Equal(t, currentUID, int(f.Sys().(*syscall.Stat_t).Uid))
+			assert.Equal(t, currentGID, int(f.Sys().(*syscall.Stat_t).Gid))
+		})
+	}
+}
+
+func Test_doChownRequestForACL(t *testing.T) {
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataDir := path.Join(rootDir, "data")
+	err = os.MkdirAll(path.Join(dataDir, "dir"), 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path.Join(dataDir, "dir", "file.txt"), []byte("MOCK_CONTENT"), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("dir/file.txt", path.Join(dataDir, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := ChownRequest{Path: "/data", User: -1, Group: -1, ACL: "u:2000:rwX", DefaultACL: "g:3000:rX"}
+	err = doChownRequest(Container{Root: rootDir}, request)
+	if !assert.NoError(t, err) {
+		return
+	}
+	target, err := resolveInRoot(rootDir, "/data/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	access, err := getACL(target, aclXattrAccess)
+	if err != nil {
+		// Not all filesystems support POSIX ACLs
+		t.Skip(err)
+	}
+	assert.Equal(t, []aclEntry{
+		{Tag: aclTagUserObj, Perm: 0o7, ID: aclUndefinedID},
+		{Tag: aclTagUser, Perm: 0o7, ID: 2000},
+		{Tag: aclTagGroupObj, Perm: 0o5, ID: aclUndefinedID},
+		{Tag: aclTagMask, Perm: 0o7, ID: aclUndefinedID},
+		{Tag: aclTagOther, Perm: 0o0, ID: aclUndefinedID},
+	}, access)
+	defaults, err := getACL(target, aclXattrDefault)
+	assert.NoError(t, err)
+	assert.Equal(t, []aclEntry{
+		{Tag: aclTagUserObj, Perm: 0o7, ID: aclUndefinedID},
+		{Tag: aclTagUser, Perm: 0o7, ID: 2000},
+		{Tag: aclTagGroupObj, Perm: 0o5, ID: aclUndefinedID},
+		{Tag: aclTagGroup, Perm: 0o5, ID: 3000},
+		{Tag: aclTagMask, Perm: 0o7, ID: aclUndefinedID},
+		{Tag: aclTagOther, Perm: 0o0, ID: aclUndefinedID},
+	}, defaults)
+
+	// The group bits of the mode reflect the mask of the ACL
+	f, err := os.Lstat(path.Join(dataDir, "dir", "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0660), f.Mode())
+	fileTarget, err := resolveInRoot(rootDir, "/data/dir/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileTarget.Close()
+	fileDefaults, err := getACL(fileTarget, aclXattrDefault)
+	assert.NoError(t, err)
+	assert.Nil(t, fileDefaults)
+
+	// Applying it again doesn't change anything
+	assert.NoError(t, doChownRequest(Container{Root: rootDir}, request))
+}
+
+func Test_doChownRequestForOnRootMismatchWithACL(t *testing.T) {
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataDir := path.Join(rootDir, "data")
+	err = os.MkdirAll(dataDir, 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path.Join(dataDir, "file.txt"), []byte("MOCK_CONTENT"), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getFileACL := func(fileName string) []aclEntry {
+		target, err := resolveInRoot(rootDir, path.Join("/data", fileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer target.Close()
+		access, err := getACL(target, aclXattrAccess)
+		if err != nil {
+			// Not all filesystems support POSIX ACLs
+			t.Skip(err)
+		}
+		return access
+	}
+
+	// The owner and mode of the root match, but the ACL doesn't
+	request := ChownRequest{Path: "/data", User: -1, Group: -1, ACL: "u:2000:rwX", Policy: PolicyOnRootMismatch}
+	assert.NoError(t, doChownRequest(Container{Root: rootDir}, request))
+	assert.NotNil(t, getFileACL("."))
+	assert.NotNil(t, getFileACL("file.txt"))
+
+	// The ACL of the root matches, the walk should be skipped
+	err = os.WriteFile(path.Join(dataDir, "added.txt"), []byte("MOCK_CONTENT"), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, doChownRequest(Container{Root: rootDir}, request))
+	assert.Nil(t, getFileACL("added.txt"))
+}
+
+func Test_doChownRequestForSELinuxRelabel(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Setting security.selinux xattr requires root privilege")
+	}
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataDir := path.Join(rootDir, "data")
+	err = os.MkdirAll(path.Join(dataDir, "dir"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path.Join(dataDir, "dir", "file.txt"), []byte("MOCK_CONTENT"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("dir/file.txt", path.Join(dataDir, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	container := Container{Root: rootDir, MountLabel: "system_u:object_r:container_file_t:s0:c1,c2"}
+
+	tests := []struct {
+		name    string
+		args    ChownRequest
+		label   string
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{
+			"private",
+			ChownRequest{Path: "/data", User: -1, Group: -1, SELinuxRelabel: SELinuxRelabelPrivate},
+			"system_u:object_r:container_file_t:s0:c1,c2",
+			assert.NoError,
+		},
+		{
+			"shared",
+			ChownRequest{Path: "/data", User: -1, Group: -1, SELinuxRelabel: SELinuxRelabelShared},
+			"system_u:object_r:container_file_t:s0",
+			assert.NoError,
+		},
+		{
+			"label",
+			ChownRequest{Path: "/data", User: -1, Group: -1, SELinuxLabel: "system_u:object_r:data_t:s0"},
+			"system_u:object_r:data_t:s0",
+			assert.NoError,
+		},
+		{
+			"no-mount-label",
+			ChownRequest{Path: "/data", User: -1, Group: -1, SELinuxRelabel: SELinuxRelabelShared},
+			"",
+			assert.Error,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testContainer := container
+			if tt.label == "" {
+				testContainer.MountLabel = ""
+			}
+			if !tt.wantErr(t, doChownRequest(testContainer, tt.args), fmt.Sprintf("doChownRequest(%v)", tt.args)) || tt.label == "" {
+				return
+			}
+			for _, filePath := range []string{"/data", "/data/dir", "/data/dir/file.txt", "/data/link"} {
+				target, err := resolveInRoot(rootDir, filePath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				label, err := getSELinuxLabel(target)
+				target.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				assert.Equal(t, tt.label, label, filePath)
+			}
+		})
+	}
+}
+
+func Test_doChownRequestForOnRootMismatchWithSELinuxLabel(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Setting security.selinux xattr requires root privilege")
+	}
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataDir := path.Join(rootDir, "data")
+	err = os.MkdirAll(dataDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path.Join(dataDir, "file.txt"), []byte("MOCK_CONTENT"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getFileLabel := func(fileName string) string {
+		target, err := resolveInRoot(rootDir, path.Join("/data", fileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer target.Close()
+		label, err := getSELinuxLabel(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return label
+	}
+	unlabeled := getFileLabel(".")
+
+	// The owner and mode of the root match, but the label doesn't
+	request := ChownRequest{
+		Path: "/data", User: -1, Group: -1, SELinuxLabel: "system_u:object_r:data_t:s0", Policy: PolicyOnRootMismatch,
+	}
+	assert.NoError(t, doChownRequest(Container{Root: rootDir}, request))
+	assert.Equal(t, request.SELinuxLabel, getFileLabel("."))
+	assert.Equal(t, request.SELinuxLabel, getFileLabel("file.txt"))
+
+	// The label of the root matches, the walk should be skipped
+	err = os.WriteFile(path.Join(dataDir, "added.txt"), []byte("MOCK_CONTENT"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, doChownRequest(Container{Root: rootDir}, request))
+	assert.Equal(t, unlabeled, getFileLabel("added.txt"))
+}
+
+func Test_doChownRequestForXattr(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Setting security.capability xattr requires root privilege")
+	}
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	binDir := path.Join(rootDir, "usr", "bin")
+	err = os.MkdirAll(binDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binPath := path.Join(binDir, "server")
+	err = os.WriteFile(binPath, []byte("MOCK_BINARY"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = unix.Setxattr(binPath, "user.origin", []byte("build"), 0)
+	if err != nil {
+		t.Skip(err)
+	}
+
+	request := ChownRequest{
+		Path:   "/usr/bin/server",
+		User:   2000,
+		Group:  2000,
+		Xattrs: map[string]string{"user.checksum": "0xff00", "user.origin": XattrRemove},
+		FCaps:  "cap_net_bind_service+ep",
+	}
+	container := Container{
+		Root:        rootDir,
+		UIDMappings: []spec.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		GIDMappings: []spec.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}},
+	}
+	err = doChownRequest(container, request)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	data := make([]byte, 64)
+	size, err := unix.Getxattr(binPath, "user.checksum", data)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0xff, 0x00}, data[:size])
+	_, err = unix.Getxattr(binPath, "user.origin", data)
+	assert.ErrorIs(t, err, unix.ENODATA)
+	// The capabilities are set after chown, which clears them
+	size, err = unix.Getxattr(binPath, fcapsXattr, data)
+	assert.NoError(t, err)
+	assert.Equal(t, fileCaps{Permitted: 1 << unix.CAP_NET_BIND_SERVICE, Effective: true}.encode(100000), data[:size])
+}
+
+func Test_detectStage(t *testing.T) {
+	tests := []struct {
+		name     string
+		argStage string
+		status   spec.ContainerState
+		want     string
+		wantErr  assert.ErrorAssertionFunc
+	}{
+		{"creating", "", spec.StateCreating, StageCreateContainer, assert.NoError},
+		{"created", "", spec.StateCreated, StageStartContainer, assert.NoError},
+		{"stopped", "", spec.StateStopped, StagePoststop, assert.NoError},
+		{"running", "", spec.StateRunning, "", assert.Error},
+		{"argument", StageCreateRuntime, spec.StateCreating, StageCreateRuntime, assert.NoError},
+	}
+	defer func(value string) { stage = value }(stage)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stage = tt.argStage
+			got, err := detectStage(spec.State{Status: tt.status})
+			if !tt.wantErr(t, err, fmt.Sprintf("detectStage(%v)", tt.status)) {
+				return
+			}
+			assert.Equalf(t, tt.want, got, "detectStage(%v)", tt.status)
+		})
+	}
+}
+
+func Test_doChownRequestThroughProcRoot(t *testing.T) {
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mountDir := path.Join(rootDir, "data")
+	err = os.Mkdir(mountDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readyPath := path.Join(rootDir, "ready")
+	// Mount a tmpfs only visible in the mount namespace of the child process, like the mounts made by the runtime
+	cmd := exec.Command(
+		"unshare", "--mount", "--propagation", "private", "sh", "-c",
+		fmt.Sprintf("mount -t tmpfs -o mode=0755 tmpfs %s && touch %s && sleep 10", mountDir, readyPath),
+	)
+	err = cmd.Start()
+	if err != nil {
+		t.Skipf("Creating mount namespace requires unshare, error: %s", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	for i := 0; i < 100; i++ {
+		if _, err = os.Stat(readyPath); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Skipf("Mounting tmpfs in a new mount namespace requires privilege, error: %s", err)
+	}
+
+	root, err := procRoot(cmd.Process.Pid, rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := ChownRequest{Path: "/data", User: -1, Group: -1, Mode: 0700}
+	assert.NoError(t, doChownRequest(Container{Root: root}, request))
+
+	// The directory under the mount is not changed
+	f, err := os.Lstat(mountDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.ModeDir|0755, f.Mode())
+	f, err = os.Lstat(path.Join(root, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.ModeDir|0700, f.Mode())
+}
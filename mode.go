@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// modeMask is the mask of file mode bits can be changed by chmod
+const modeMask = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// unixMode converts the mode bits in the format of chmod(2), such as 01777, to os.FileMode
+func unixMode(mode uint32) os.FileMode {
+	fileMode := os.FileMode(mode) & os.ModePerm
+	if mode&0o4000 != 0 {
+		fileMode |= os.ModeSetuid
+	}
+	if mode&0o2000 != 0 {
+		fileMode |= os.ModeSetgid
+	}
+	if mode&0o1000 != 0 {
+		fileMode |= os.ModeSticky
+	}
+	return fileMode
+}
+
+const (
+	whoUser  = 0o700
+	whoGroup = 0o070
+	whoOther = 0o007
+	whoAll   = 0o777
+)
+
+type symbolicOp struct {
+	// The operator, one of +, - and =
+	Operator byte
+	// The permission letters, such as rwxXst, or a single u, g or o for copying permissions
+	Perms string
+}
+
+type symbolicClause struct {
+	// The permission bits mask of the affected users
+	Who os.FileMode
+	Ops []symbolicOp
+}
+
+// symbolicMode is a parsed chmod(1) style symbolic mode expression, such as u+rwX,g+rX,o-rwx
+type symbolicMode []symbolicClause
+
+// parseSymbolicMode parses chmod(1) style symbolic mode expression. If no user is provided in a clause, such as
+// +x, it applies to all of the users regardless of the umask.
+func parseSymbolicMode(expr string) (symbolicMode, error) {
+	if expr == "" {
+		return nil, fmt.Errorf("Empty symbolic mode")
+	}
+	var mode symbolicMode
+	for _, clauseExpr := range strings.Split(expr, ",") {
+		clause := symbolicClause{}
+		index := 0
+		for ; index < len(clauseExpr) && strings.IndexByte("ugoa", clauseExpr[index]) != -1; index++ {
+			switch clauseExpr[index] {
+			case 'u':
+				clause.Who |= whoUser
+			case 'g':
+				clause.Who |= whoGroup
+			case 'o':
+				clause.Who |= whoOther
+			case 'a':
+				clause.Who |= whoAll
+			}
+		}
+		if clause.Who == 0 {
+			clause.Who = whoAll
+		}
+		if index >= len(clauseExpr) {
+			return nil, fmt.Errorf("Missing operator in symbolic mode clause %q", clauseExpr)
+		}
+		for index < len(clauseExpr) {
+			op := symbolicOp{Operator: clauseExpr[index]}
+			if op.Operator != '+' && op.Operator != '-' && op.Operator != '=' {
+				return nil, fmt.Errorf("Invalid operator %q in symbolic mode clause %q", op.Operator, clauseExpr)
+			}
+			index++
+			start := index
+			for index < len(clauseExpr) && strings.IndexByte("+-=", clauseExpr[index]) == -1 {
+				index++
+			}
+			op.Perms = clauseExpr[start:index]
+			if len(op.Perms) == 1 && strings.Contains("ugo", op.Perms) {
+				clause.Ops = append(clause.Ops, op)
+				continue
+			}
+			for _, perm := range op.Perms {
+				if !strings.ContainsRune("rwxXst", perm) {
+					return nil, fmt.Errorf("Invalid permission %q in symbolic mode clause %q", perm, clauseExpr)
+				}
+			}
+			clause.Ops = append(clause.Ops, op)
+		}
+		mode = append(mode, clause)
+	}
+	return mode, nil
+}
+
+// bits returns the mode bits of the operation for given current mode
+func (op symbolicOp) bits(who os.FileMode, mode os.FileMode, isDir bool) os.FileMode {
+	var bits os.FileMode
+	if len(op.Perms) == 1 && strings.Contains("ugo", op.Perms) {
+		var perm os.FileMode
+		switch op.Perms {
+		case "u":
+			perm = (mode >> 6) & 0o7
+		case "g":
+			perm = (mode >> 3) & 0o7
+		case "o":
+			perm = mode & 0o7
+		}
+		return (perm<<6 | perm<<3 | perm) & who
+	}
+	for _, perm := range op.Perms {
+		switch perm {
+		case 'r':
+			bits |= 0o444 & who
+		case 'w':
+			bits |= 0o222 & who
+		case 'x':
+			bits |= 0o111 & who
+		case 'X':
+			if isDir || mode&0o111 != 0 {
+				bits |= 0o111 & who
+			}
+		case 's':
+			if who&whoUser != 0 {
+				bits |= os.ModeSetuid
+			}
+			if who&whoGroup != 0 {
+				bits |= os.ModeSetgid
+			}
+		case 't':
+			if who&whoOther != 0 {
+				bits |= os.ModeSticky
+			}
+		}
+	}
+	return bits
+}
+
+// apply applies the symbolic mode to the given mode and returns the result
+func (symbolic symbolicMode) apply(mode os.FileMode, isDir bool) os.FileMode {
+	mode &= modeMask
+	for _, clause := range symbolic {
+		for _, op := range clause.Ops {
+			bits := op.bits(clause.Who, mode, isDir)
+			switch op.Operator {
+			case '+':
+				mode |= bits
+			case '-':
+				mode &^= bits
+			case '=':
+				clearBits := clause.Who
+				// Like chmod(1), setuid and setgid bits of directories are preserved unless specified explicitly
+				if !isDir && clause.Who&whoUser != 0 {
+					clearBits |= os.ModeSetuid
+				}
+				if !isDir && clause.Who&whoGroup != 0 {
+					clearBits |= os.ModeSetgid
+				}
+				if clause.Who&whoOther != 0 {
+					clearBits |= os.ModeSticky
+				}
+				mode = (mode &^ clearBits) | bits
+			}
+		}
+	}
+	return mode
+}
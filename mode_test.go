@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func Test_parseSymbolicMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    string
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{"single", "u+x", assert.NoError},
+		{"multiple", "u+rwX,g+rX,o-rwx", assert.NoError},
+		{"implicit-all", "+x", assert.NoError},
+		{"multiple-ops", "u=rw+x", assert.NoError},
+		{"copy", "g=u", assert.NoError},
+		{"empty-perms", "o=", assert.NoError},
+		{"empty", "", assert.Error},
+		{"empty-clause", "u+x,", assert.Error},
+		{"missing-operator", "ug", assert.Error},
+		{"invalid-operator", "u*x", assert.Error},
+		{"invalid-perm", "u+z", assert.Error},
+		{"octal", "755", assert.Error},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseSymbolicMode(tt.expr)
+			tt.wantErr(t, err, fmt.Sprintf("parseSymbolicMode(%v)", tt.expr))
+		})
+	}
+}
+
+func Test_symbolicMode_apply(t *testing.T) {
+	type args struct {
+		mode  os.FileMode
+		isDir bool
+	}
+	tests := []struct {
+		name string
+		expr string
+		args args
+		want os.FileMode
+	}{
+		{"add", "u+x", args{0o644, false}, 0o744},
+		{"remove", "o-rwx", args{0o777, false}, 0o770},
+		{"set", "g=r", args{0o777, false}, 0o747},
+		{"implicit-all", "+x", args{0o644, false}, 0o755},
+		{"all", "a-w", args{0o666, false}, 0o444},
+		{"conditional-exec-file", "g+X", args{0o600, false}, 0o600},
+		{"conditional-exec-exec-file", "g+X", args{0o700, false}, 0o710},
+		{"conditional-exec-dir", "g+X", args{0o700, true}, 0o710},
+		{"multiple", "u+rwX,g+rX,o-rwx", args{0o604, true}, 0o750},
+		{"copy", "g=u", args{0o640, false}, 0o660},
+		{"multiple-ops", "u=rw+x", args{0o000, false}, 0o700},
+		{"setgid", "g+s", args{0o755, true}, os.ModeSetgid | 0o755},
+		{"sticky", "+t", args{0o777, true}, os.ModeSticky | 0o777},
+		{"set-clears-setuid-of-file", "u=rwx", args{os.ModeSetuid | 0o755, false}, 0o755},
+		{"set-keeps-setgid-of-dir", "g=rx", args{os.ModeSetgid | 0o775, true}, os.ModeSetgid | 0o755},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			symbolic, err := parseSymbolicMode(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equalf(t, tt.want, symbolic.apply(tt.args.mode, tt.args.isDir), "apply(%v, %v)", tt.args.mode, tt.args.isDir)
+		})
+	}
+}
+
+func Test_unixMode(t *testing.T) {
+	tests := []struct {
+		name string
+		mode uint32
+		want os.FileMode
+	}{
+		{"perm", 0o755, 0o755},
+		{"setuid", 0o4755, os.ModeSetuid | 0o755},
+		{"setgid", 0o2775, os.ModeSetgid | 0o775},
+		{"sticky", 0o1777, os.ModeSticky | 0o777},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equalf(t, tt.want, unixMode(tt.mode), "unixMode(%o)", tt.mode)
+		})
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// procRoot returns the path of the container root through the root of the container process in procfs. As it refers
+// to the root of the mount namespace of the process, the mounts only visible in the container's mount namespace can
+// be accessed through it. It's only valid before pivot_root is called, when the container root is still a path in
+// the mount namespace.
+func procRoot(pid int, containerRoot string) (string, error) {
+	if pid <= 0 {
+		return "", fmt.Errorf("No pid of the container process in the state")
+	}
+	return path.Join(fmt.Sprintf("/proc/%d/root", pid), containerRoot), nil
+}
+
+// openat2InRoot opens the file at the given path inside the container root with given flags. The path is resolved
+// by the kernel as if the container root is the "/", so that a symlink pointing to an absolute path or to ".." cannot
+// escape from it.
+func openat2InRoot(containerRoot string, filePath string, flags int) (*os.File, error) {
+	rootFd, err := unix.Open(containerRoot, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: containerRoot, Err: err}
+	}
+	defer unix.Close(rootFd)
+	fd, err := unix.Openat2(rootFd, filePath, &unix.OpenHow{
+		Flags:   uint64(flags) | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS,
+	})
+	if err != nil {
+		return nil, &os.PathError{Op: "openat2", Path: filePath, Err: err}
+	}
+	return os.NewFile(uintptr(fd), path.Join(containerRoot, filePath)), nil
+}
+
+// openInRoot opens the regular file at the given path inside the container root for reading. It's opened without
+// blocking, so that a FIFO in an untrusted image cannot block the hook, and anything other than a regular file is
+// refused.
+func openInRoot(containerRoot string, filePath string) (*os.File, error) {
+	file, err := openat2InRoot(containerRoot, filePath, unix.O_RDONLY|unix.O_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, fmt.Errorf("Expected %s to be a regular file but got %s instead", filePath, info.Mode().Type())
+	}
+	return file, nil
+}
+
+// resolveInRoot opens the file at the given path inside the container root as an O_PATH file without following the
+// symlink of the last component, like what lstat does. The returned file can only be used for changing the owner or
+// mode of the exact file resolved, no matter what happens to the path later.
+func resolveInRoot(containerRoot string, filePath string) (*os.File, error) {
+	return openat2InRoot(containerRoot, filePath, unix.O_PATH|unix.O_NOFOLLOW)
+}
+
+// resolveExistingInRoot opens the nearest existing one of the given path and its parents inside the container root as
+// an O_PATH file. Unlike resolveInRoot, the symlink of the last component is followed, as it's where the missing
+// components would be created under.
+func resolveExistingInRoot(containerRoot string, filePath string) (*os.File, error) {
+	filePath = path.Clean("/" + filePath)
+	for {
+		target, err := openat2InRoot(containerRoot, filePath, unix.O_PATH)
+		if errors.Is(err, unix.ENOENT) && filePath != "/" {
+			filePath = path.Dir(filePath)
+			continue
+		}
+		return target, err
+	}
+}
+
+// createInRoot creates the file or directory at the given path inside the container root if it doesn't exist, along
+// with the missing parent directories. The parents are created with mode 0755 and owned by parentUID and parentGID,
+// a negative value means leaving it as the one of the hook process. The existing components of the path are resolved
+// inside the container root like openat2InRoot does. It returns true if the file is created.
+func createInRoot(
+	containerRoot string, filePath string, isDir bool, mode os.FileMode, parentUID int, parentGID int,
+) (bool, error) {
+	rootFd, err := unix.Open(containerRoot, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return false, &os.PathError{Op: "open", Path: containerRoot, Err: err}
+	}
+	root := os.NewFile(uintptr(rootFd), containerRoot)
+	defer root.Close()
+	parent := root
+	setParent := func(file *os.File) {
+		if parent != root {
+			parent.Close()
+		}
+		parent = file
+	}
+	defer setParent(root)
+
+	components := strings.Split(strings.Trim(path.Clean(filePath), "/"), "/")
+	currentPath := "/"
+	for index, name := range components {
+		isLast := index == len(components)-1
+		currentPath = path.Join(currentPath, name)
+		flags := unix.O_PATH | unix.O_CLOEXEC
+		if isLast {
+			flags |= unix.O_NOFOLLOW
+		}
+		fd, err := unix.Openat2(rootFd, currentPath, &unix.OpenHow{
+			Flags:   uint64(flags),
+			Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS,
+		})
+		if err == nil {
+			if isLast {
+				unix.Close(fd)
+				return false, nil
+			}
+			setParent(os.NewFile(uintptr(fd), path.Join(containerRoot, currentPath)))
+			continue
+		}
+		if !errors.Is(err, unix.ENOENT) {
+			return false, &os.PathError{Op: "openat2", Path: currentPath, Err: err}
+		}
+
+		createMode := os.FileMode(0o755)
+		if isLast {
+			createMode = mode
+		}
+		if isLast && !isDir {
+			fd, err = unix.Openat(
+				int(parent.Fd()), name, unix.O_CREAT|unix.O_EXCL|unix.O_WRONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC,
+				uint32(createMode.Perm()),
+			)
+			if err == nil {
+				unix.Close(fd)
+			}
+		} else {
+			err = unix.Mkdirat(int(parent.Fd()), name, uint32(createMode.Perm()))
+		}
+		if err != nil {
+			return false, &os.PathError{Op: "create", Path: path.Join(parent.Name(), name), Err: err}
+		}
+		created, err := openAt(parent, name)
+		if err != nil {
+			return false, err
+		}
+		setParent(created)
+		// The mode could be masked by the umask, set it explicitly
+		err = fchmod(created, createMode)
+		if err != nil {
+			return false, err
+		}
+		if !isLast && (parentUID >= 0 || parentGID >= 0) {
+			err = fchown(created, parentUID, parentGID)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
+
+// fdPath returns the procfs path of the file descriptor, accessing it follows the magic link to the exact file
+func fdPath(target *os.File) string {
+	return fmt.Sprintf("/proc/self/fd/%d", target.Fd())
+}
+
+// mountID returns the id of the mount the file opened as O_PATH is on, which requires Linux 5.8 or above
+func mountID(target *os.File) (uint64, error) {
+	var stat unix.Statx_t
+	err := unix.Statx(int(target.Fd()), "", unix.AT_EMPTY_PATH|unix.AT_SYMLINK_NOFOLLOW, unix.STATX_MNT_ID, &stat)
+	if err != nil {
+		return 0, &os.PathError{Op: "statx", Path: target.Name(), Err: err}
+	}
+	if stat.Mask&unix.STATX_MNT_ID == 0 {
+		return 0, &os.PathError{Op: "statx", Path: target.Name(), Err: unix.ENOTSUP}
+	}
+	return stat.Mnt_id, nil
+}
+
+// fchown changes the owner of the file opened as O_PATH without following symlink
+func fchown(target *os.File, uid int, gid int) error {
+	err := unix.Fchownat(int(target.Fd()), "", uid, gid, unix.AT_EMPTY_PATH)
+	if err != nil {
+		return &os.PathError{Op: "fchownat", Path: target.Name(), Err: err}
+	}
+	return nil
+}
+
+// fchmod changes the mode of the file opened as O_PATH. As fchmodat doesn't support AT_EMPTY_PATH, it's done via the
+// procfs magic link of the file descriptor, which refers to the exact file instead of a path to be resolved again.
+// The caller must not call it with a symlink, otherwise the mode of the symlink target will be changed.
+func fchmod(target *os.File, mode os.FileMode) error {
+	err := os.Chmod(fdPath(target), mode)
+	if err != nil {
+		return &os.PathError{Op: "chmod", Path: target.Name(), Err: err}
+	}
+	return nil
+}
+
+// openAt opens the file with given name in the directory as an O_PATH file without following symlink
+func openAt(dir *os.File, name string) (*os.File, error) {
+	fd, err := unix.Openat(int(dir.Fd()), name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "openat", Path: path.Join(dir.Name(), name), Err: err}
+	}
+	return os.NewFile(uintptr(fd), path.Join(dir.Name(), name)), nil
+}
+
+// readDirNames reads the sorted entry names of the directory opened as O_PATH
+func readDirNames(dir *os.File) ([]string, error) {
+	fd, err := unix.Openat(int(dir.Fd()), ".", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "openat", Path: dir.Name(), Err: err}
+	}
+	dirFile := os.NewFile(uintptr(fd), dir.Name())
+	defer dirFile.Close()
+	names, err := dirFile.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// walkOptions is the options for walking through files
+type walkOptions struct {
+	// The number of directories to walk in parallel
+	Concurrency int
+	// Walk into files on other filesystems than the root's, such as nested mount points
+	CrossMounts bool
+	// Only call fn for files matching any of the glob patterns if not empty
+	Include []string
+	// Skip files matching any of the glob patterns, excluded directories are not walked into
+	Exclude []string
+	// Only call fn for files at the depth or deeper, the root is at depth 0
+	MinDepth int
+	// Do not walk into directories deeper than the depth if it's not zero
+	MaxDepth int
+}
+
+// walker walks through files with a bounded number of goroutines, each of them walks a directory at a time
+type walker struct {
+	options walkOptions
+	// The device of the root file
+	rootDev uint64
+	fn      func(relPath string, target *os.File, file os.FileInfo)
+	// The semaphore for the extra goroutines besides the one calling walkFiles
+	sem  chan struct{}
+	wg   sync.WaitGroup
+	lock sync.Mutex
+	err  error
+}
+
+func (w *walker) setErr(err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *walker) failed() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.err != nil
+}
+
+// walkFiles walks through the given file recursively and calls fn for each file, including the root itself.
+// Each file is opened as O_PATH without following symlink relative to the file descriptor of its parent directory,
+// and passed to fn along with its path relative to the root. As the walk never resolves a path more than one
+// component, a container process replacing the files with symlinks during the walk cannot redirect it.
+// Up to the given concurrency of directories are walked in parallel, fn needs to be safe for concurrent calls if
+// it's more than one. Unless CrossMounts is set, directories on other filesystems than the root's are not walked into,
+// like what `find -xdev` does, but they're still processed themselves. The Include and Exclude glob patterns are
+// matched against the relative paths of files under the root, the root itself is always included unless MinDepth is
+// greater than zero.
+func walkFiles(root *os.File, options walkOptions, fn func(relPath string, target *os.File, file os.FileInfo)) error {
+	rootFile, err := root.Stat()
+	if err != nil {
+		return err
+	}
+	concurrency := options.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	w := &walker{
+		options: options,
+		rootDev: uint64(rootFile.Sys().(*syscall.Stat_t).Dev),
+		fn:      fn,
+		sem:     make(chan struct{}, concurrency-1),
+	}
+	err = w.walkFile(root, ".", rootFile, 0)
+	if err != nil {
+		w.setErr(err)
+	}
+	w.wg.Wait()
+	return w.err
+}
+
+func (w *walker) walkFile(target *os.File, relPath string, file os.FileInfo, depth int) error {
+	if depth >= w.options.MinDepth &&
+		(relPath == "." || len(w.options.Include) == 0 || matchAnyGlob(w.options.Include, relPath)) {
+		w.fn(relPath, target, file)
+	}
+	if !file.IsDir() || (w.options.MaxDepth > 0 && depth >= w.options.MaxDepth) {
+		return nil
+	}
+	if !w.options.CrossMounts && uint64(file.Sys().(*syscall.Stat_t).Dev) != w.rootDev {
+		log.Infof("The directory %s is on another filesystem, skip walking into it", target.Name())
+		return nil
+	}
+	names, err := readDirNames(target)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if w.failed() {
+			return nil
+		}
+		childPath := path.Join(relPath, name)
+		if matchAnyGlob(w.options.Exclude, childPath) {
+			log.Debugf("The file %s is excluded, skip", path.Join(target.Name(), name))
+			continue
+		}
+		child, err := openAt(target, name)
+		if err != nil {
+			// The file could be removed during the walk
+			if errors.Is(err, unix.ENOENT) {
+				continue
+			}
+			return err
+		}
+		childFile, err := child.Stat()
+		if err != nil {
+			child.Close()
+			return err
+		}
+		if childFile.IsDir() {
+			// Fan out the sub-directory to another goroutine if there's any available, otherwise walk it inline
+			select {
+			case w.sem <- struct{}{}:
+				w.wg.Add(1)
+				go func() {
+					defer w.wg.Done()
+					defer func() { <-w.sem }()
+					defer child.Close()
+					err := w.walkFile(child, childPath, childFile, depth+1)
+					if err != nil {
+						w.setErr(err)
+					}
+				}()
+				continue
+			default:
+			}
+		}
+		err = w.walkFile(child, childPath, childFile, depth+1)
+		child.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
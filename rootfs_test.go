@@ -0,0 +1,518 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+func Test_resolveInRoot(t *testing.T) {
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outsideDir, err := os.MkdirTemp("", "outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(path.Join(rootDir, "data", "nested"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(path.Join(outsideDir, "nested"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Absolute and relative symlinks pointing to the outside of container root
+	err = os.Symlink(outsideDir, path.Join(rootDir, "abs-link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("../../../../../../.."+outsideDir, path.Join(rootDir, "rel-link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("/data", path.Join(rootDir, "inside-link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		filePath string
+		// The expected file in the container root, or empty if error is expected
+		want string
+	}{
+		{"plain", "/data/nested", path.Join(rootDir, "data", "nested")},
+		{"inside-link", "/inside-link/nested", path.Join(rootDir, "data", "nested")},
+		{"abs-link", "/abs-link/nested", ""},
+		{"rel-link", "/rel-link/nested", ""},
+		{"dot-dot", "/../../../../../.." + outsideDir + "/nested", ""},
+		{"last-link-not-followed", "/abs-link", path.Join(rootDir, "abs-link")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, err := resolveInRoot(rootDir, tt.filePath)
+			if tt.want == "" {
+				assert.Error(t, err)
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer target.Close()
+			targetInfo, err := target.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantInfo, err := os.Lstat(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.True(t, os.SameFile(wantInfo, targetInfo))
+		})
+	}
+}
+
+func Test_procRoot(t *testing.T) {
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(path.Join(rootDir, "data"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = procRoot(0, rootDir)
+	assert.Error(t, err)
+
+	// The process shares the mount namespace with the test, so it should resolve to the same file
+	root, err := procRoot(os.Getpid(), rootDir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, fmt.Sprintf("/proc/%d/root%s", os.Getpid(), rootDir), root)
+	target, err := resolveInRoot(root, "/data")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer target.Close()
+	expected, err := os.Stat(path.Join(rootDir, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := target.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, os.SameFile(expected, actual))
+}
+
+func Test_createInRoot(t *testing.T) {
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outsideDir, err := os.MkdirTemp("", "outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(path.Join(rootDir, "data"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("/data", path.Join(rootDir, "inside-link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(outsideDir, path.Join(rootDir, "outside-link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type args struct {
+		filePath string
+		isDir    bool
+		mode     os.FileMode
+	}
+	tests := []struct {
+		name    string
+		args    args
+		created bool
+		// The expected modes of files in the container root after creating
+		modes   map[string]os.FileMode
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{
+			"existing",
+			args{"/data", true, 0777},
+			false,
+			map[string]os.FileMode{"data": os.ModeDir | 0700},
+			assert.NoError,
+		},
+		{
+			"dir-with-parents",
+			args{"/data/tenant/nested", true, 0770},
+			true,
+			map[string]os.FileMode{"data": os.ModeDir | 0700, "data/tenant": os.ModeDir | 0755, "data/tenant/nested": os.ModeDir | 0770},
+			assert.NoError,
+		},
+		{
+			"file",
+			args{"/inside-link/tenant/file.txt", false, 0600},
+			true,
+			map[string]os.FileMode{"data/tenant/file.txt": 0600},
+			assert.NoError,
+		},
+		{
+			"outside-link",
+			args{"/outside-link/file.txt", false, 0600},
+			false,
+			map[string]os.FileMode{},
+			assert.Error,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			created, err := createInRoot(rootDir, tt.args.filePath, tt.args.isDir, tt.args.mode, -1, -1)
+			if !tt.wantErr(t, err) {
+				return
+			}
+			assert.Equal(t, tt.created, created)
+			for filePath, expectedMode := range tt.modes {
+				f, err := os.Lstat(path.Join(rootDir, filePath))
+				if err != nil {
+					t.Fatal(err)
+				}
+				assert.Equal(t, expectedMode, f.Mode(), filePath)
+			}
+		})
+	}
+	entries, err := os.ReadDir(outsideDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, entries)
+}
+
+func Test_walkFilesWithSymlinkSwap(t *testing.T) {
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outsideDir, err := os.MkdirTemp("", "outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outsideFilePath := path.Join(outsideDir, "file.txt")
+	err = os.WriteFile(outsideFilePath, []byte("MOCK_CONTENT"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mountDir := path.Join(rootDir, "data")
+	for _, dirName := range []string{"early", "late"} {
+		err = os.MkdirAll(path.Join(mountDir, dirName), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path.Join(mountDir, dirName, "file.txt"), []byte("MOCK_CONTENT"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Simulates a container process swapping a directory with a symlink pointing to the outside
+	swap := func(name string) {
+		dirPath := path.Join(mountDir, name)
+		err := os.Rename(dirPath, dirPath+".orig")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Symlink(outsideDir, dirPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root, err := resolveInRoot(rootDir, "/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	var visited []string
+	err = walkFiles(root, walkOptions{Concurrency: 1}, func(relPath string, target *os.File, file os.FileInfo) {
+		visited = append(visited, relPath)
+		if relPath == "." {
+			// Swapped before the directory is read
+			swap("early")
+		} else if relPath == "late" {
+			// Swapped after the directory is opened
+			swap("late")
+		}
+		chmodFile("data", target, file, 0777)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(visited)
+	assert.Equal(t, []string{".", "early", "early.orig", "early.orig/file.txt", "late", "late/file.txt"}, visited)
+	f, err := os.Lstat(outsideFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0600), f.Mode().Perm())
+	f, err = os.Lstat(outsideDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0700), f.Mode().Perm())
+	// The original directory opened before swapping is changed instead
+	f, err = os.Lstat(path.Join(mountDir, "late.orig", "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0777), f.Mode().Perm())
+}
+
+func Test_walkFilesWithMounts(t *testing.T) {
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mountPath := path.Join(rootDir, "data", "mount")
+	err = os.MkdirAll(mountPath, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Mount("tmpfs", mountPath, "tmpfs", 0, "")
+	if err != nil {
+		t.Skipf("Mounting tmpfs requires privilege, error: %s", err)
+	}
+	defer syscall.Unmount(mountPath, 0)
+	err = os.WriteFile(path.Join(mountPath, "file.txt"), []byte("MOCK_CONTENT"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A regular file on another filesystem, like the files of overlayfs without xino
+	boundPath := path.Join(rootDir, "data", "bound.txt")
+	err = os.WriteFile(boundPath, []byte("MOCK_CONTENT"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Mount(path.Join(mountPath, "file.txt"), boundPath, "", syscall.MS_BIND, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Unmount(boundPath, 0)
+
+	root, err := resolveInRoot(rootDir, "/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	walk := func(crossMounts bool) []string {
+		var visited []string
+		err := walkFiles(root, walkOptions{CrossMounts: crossMounts}, func(relPath string, target *os.File, file os.FileInfo) {
+			visited = append(visited, relPath)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return visited
+	}
+	assert.Equal(t, []string{".", "bound.txt", "mount"}, walk(false))
+	assert.Equal(t, []string{".", "bound.txt", "mount", "mount/file.txt"}, walk(true))
+}
+
+func Test_walkFilesWithGlobs(t *testing.T) {
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dirPath := range []string{"cache/nested", "run", "project/.git"} {
+		err = os.MkdirAll(path.Join(rootDir, "data", dirPath), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, filePath := range []string{"cache/nested/file.txt", "run/app.sock", "run/app.pid", "project/.git/HEAD"} {
+		err = os.WriteFile(path.Join(rootDir, "data", filePath), []byte("MOCK_CONTENT"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root, err := resolveInRoot(rootDir, "/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	tests := []struct {
+		name    string
+		options walkOptions
+		want    []string
+	}{
+		{
+			"exclude",
+			walkOptions{Exclude: []string{"cache/**", ".git"}},
+			[]string{".", "project", "run", "run/app.pid", "run/app.sock"},
+		},
+		{
+			"include",
+			walkOptions{Include: []string{"**/*.sock", "HEAD"}},
+			[]string{".", "project/.git/HEAD", "run/app.sock"},
+		},
+		{
+			"include-and-exclude",
+			walkOptions{Include: []string{"*.sock", "HEAD"}, Exclude: []string{"project"}},
+			[]string{".", "run/app.sock"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var visited []string
+			err := walkFiles(root, tt.options, func(relPath string, target *os.File, file os.FileInfo) {
+				visited = append(visited, relPath)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, visited)
+		})
+	}
+}
+
+func Test_walkFilesWithDepth(t *testing.T) {
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(path.Join(rootDir, "data", "tenant", "nested"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path.Join(rootDir, "data", "tenant", "nested", "file.txt"), []byte("MOCK_CONTENT"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := resolveInRoot(rootDir, "/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	tests := []struct {
+		name    string
+		options walkOptions
+		want    []string
+	}{
+		{"unlimited", walkOptions{}, []string{".", "tenant", "tenant/nested", "tenant/nested/file.txt"}},
+		{"max-depth-1", walkOptions{MaxDepth: 1}, []string{".", "tenant"}},
+		{"max-depth-2", walkOptions{MaxDepth: 2}, []string{".", "tenant", "tenant/nested"}},
+		{"children-only", walkOptions{MinDepth: 1, MaxDepth: 1}, []string{"tenant"}},
+		{"min-depth-2", walkOptions{MinDepth: 2}, []string{"tenant/nested", "tenant/nested/file.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var visited []string
+			err := walkFiles(root, tt.options, func(relPath string, target *os.File, file os.FileInfo) {
+				visited = append(visited, relPath)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, visited)
+		})
+	}
+}
+
+func createMockTree(t testing.TB, dirCount int, fileCount int) string {
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < dirCount; i++ {
+		dirPath := path.Join(rootDir, "data", fmt.Sprintf("dir%d", i), "nested")
+		err = os.MkdirAll(dirPath, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < fileCount; j++ {
+			err = os.WriteFile(path.Join(dirPath, fmt.Sprintf("file%d.txt", j)), []byte("MOCK_CONTENT"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return rootDir
+}
+
+func Test_walkFilesWithConcurrency(t *testing.T) {
+	rootDir := createMockTree(t, 20, 10)
+	defer os.RemoveAll(rootDir)
+	root, err := resolveInRoot(rootDir, "/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+
+	walk := func(concurrency int) []string {
+		var lock sync.Mutex
+		var visited []string
+		err := walkFiles(root, walkOptions{Concurrency: concurrency}, func(relPath string, target *os.File, file os.FileInfo) {
+			lock.Lock()
+			defer lock.Unlock()
+			visited = append(visited, relPath)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(visited)
+		return visited
+	}
+	expected := walk(1)
+	// root, 20 dirs with a nested dir in each of them and 10 files in each nested dir
+	assert.Equal(t, 1+20*2+20*10, len(expected))
+	for _, concurrency := range []int{0, 2, 8, 64} {
+		assert.Equal(t, expected, walk(concurrency), "concurrency=%d", concurrency)
+	}
+}
+
+func Benchmark_walkFiles(b *testing.B) {
+	if os.Geteuid() != 0 {
+		b.Skip("Changing owner to another user requires root privilege")
+	}
+	rootDir := createMockTree(b, 200, 50)
+	defer os.RemoveAll(rootDir)
+	// Avoid measuring the logging of every file
+	logLevel := log.GetLevel()
+	log.SetLevel(log.WarnLevel)
+	defer log.SetLevel(logLevel)
+	root, err := resolveInRoot(rootDir, "/data")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer root.Close()
+	for _, concurrency := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("concurrency-%d", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				// Alternate the owner, so that every file is actually changed in each iteration
+				uid, gid := 2000+i%2, 2000+i%2
+				err := walkFiles(root, walkOptions{Concurrency: concurrency}, func(relPath string, target *os.File, file os.FileInfo) {
+					chownFile("data", target, file, uid, gid, -1, -1)
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"strings"
+)
+
+const (
+	SELinuxRelabelShared  string = "shared"
+	SELinuxRelabelPrivate        = "private"
+)
+
+const (
+	selinuxXattr string = "security.selinux"
+	// The level of shared content, like what the :z option of podman does
+	selinuxSharedLevel string = "s0"
+)
+
+// validateSELinuxLabel checks if the SELinux context is in user:role:type[:level] format
+func validateSELinuxLabel(label string) error {
+	parts := strings.SplitN(label, ":", 4)
+	if len(parts) < 3 {
+		return fmt.Errorf("Expected user:role:type[:level] in SELinux label but got %q instead", label)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return fmt.Errorf("Expected user:role:type[:level] in SELinux label but got %q instead", label)
+		}
+	}
+	return nil
+}
+
+// selinuxFileLabel returns the SELinux context for files, if shared is true, the level of it is replaced with s0 so
+// that it can be accessed by all containers, like the :z option of podman, otherwise it's returned as it is, like
+// the :Z option
+func selinuxFileLabel(label string, shared bool) (string, error) {
+	err := validateSELinuxLabel(label)
+	if err != nil {
+		return "", err
+	}
+	parts := strings.SplitN(label, ":", 4)
+	if shared && len(parts) == 4 {
+		parts[3] = selinuxSharedLevel
+	}
+	return strings.Join(parts, ":"), nil
+}
+
+// getSELinuxLabel reads the SELinux context of the file opened as O_PATH, it returns an empty string if there's none
+func getSELinuxLabel(target *os.File) (string, error) {
+	data := make([]byte, 256)
+	for {
+		size, err := unix.Getxattr(fdPath(target), selinuxXattr, data)
+		if errors.Is(err, unix.ENODATA) {
+			return "", nil
+		}
+		if errors.Is(err, unix.ERANGE) {
+			data = make([]byte, len(data)*2)
+			continue
+		}
+		if err != nil {
+			return "", &os.PathError{Op: "getxattr", Path: target.Name(), Err: err}
+		}
+		return strings.TrimRight(string(data[:size]), "\x00"), nil
+	}
+}
+
+// setSELinuxLabel sets the SELinux context of the file opened as O_PATH, symlinks are labeled as well like `chcon -h`
+// does
+func setSELinuxLabel(target *os.File, label string) error {
+	return setXattr(target, selinuxXattr, append([]byte(label), 0))
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_selinuxFileLabel(t *testing.T) {
+	type args struct {
+		label  string
+		shared bool
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    string
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{
+			"private",
+			args{"system_u:object_r:container_file_t:s0:c1,c2", false},
+			"system_u:object_r:container_file_t:s0:c1,c2",
+			assert.NoError,
+		},
+		{
+			"shared",
+			args{"system_u:object_r:container_file_t:s0:c1,c2", true},
+			"system_u:object_r:container_file_t:s0",
+			assert.NoError,
+		},
+		{"shared-without-level", args{"system_u:object_r:container_file_t", true}, "system_u:object_r:container_file_t", assert.NoError},
+		{"missing-type", args{"system_u:object_r", false}, "", assert.Error},
+		{"empty-part", args{"system_u::container_file_t:s0", false}, "", assert.Error},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selinuxFileLabel(tt.args.label, tt.args.shared)
+			if !tt.wantErr(t, err, fmt.Sprintf("selinuxFileLabel(%v, %v)", tt.args.label, tt.args.shared)) {
+				return
+			}
+			assert.Equalf(t, tt.want, got, "selinuxFileLabel(%v, %v)", tt.args.label, tt.args.shared)
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	passwdPath string = "/etc/passwd"
+	groupPath  string = "/etc/group"
+)
+
+type passwdEntry struct {
+	Name string
+	UID  int
+	GID  int
+}
+
+type groupEntry struct {
+	Name string
+	GID  int
+}
+
+// parseDatabase reads colon separated lines from a passwd or group database and calls the given function with
+// the fields of each line. Empty lines and comments are skipped.
+func parseDatabase(reader io.Reader, minFields int, fn func(fields []string) error) error {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < minFields {
+			continue
+		}
+		err := fn(fields)
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func parsePasswd(reader io.Reader) ([]passwdEntry, error) {
+	var entries []passwdEntry
+	err := parseDatabase(reader, 4, func(fields []string) error {
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil
+		}
+		gid, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil
+		}
+		entries = append(entries, passwdEntry{Name: fields[0], UID: uid, GID: gid})
+		return nil
+	})
+	return entries, err
+}
+
+func parseGroup(reader io.Reader) ([]groupEntry, error) {
+	var entries []groupEntry
+	err := parseDatabase(reader, 3, func(fields []string) error {
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil
+		}
+		entries = append(entries, groupEntry{Name: fields[0], GID: gid})
+		return nil
+	})
+	return entries, err
+}
+
+// lookupUser finds the user with given name in the passwd database of the container root
+func lookupUser(containerRoot string, name string) (passwdEntry, error) {
+	file, err := openInRoot(containerRoot, passwdPath)
+	if err != nil {
+		return passwdEntry{}, err
+	}
+	defer file.Close()
+	entries, err := parsePasswd(file)
+	if err != nil {
+		return passwdEntry{}, err
+	}
+	for _, entry := range entries {
+		if entry.Name == name {
+			return entry, nil
+		}
+	}
+	return passwdEntry{}, fmt.Errorf("User %s not found in %s of the container", name, passwdPath)
+}
+
+// lookupGroup finds the group with given name in the group database of the container root
+func lookupGroup(containerRoot string, name string) (groupEntry, error) {
+	file, err := openInRoot(containerRoot, groupPath)
+	if err != nil {
+		return groupEntry{}, err
+	}
+	defer file.Close()
+	entries, err := parseGroup(file)
+	if err != nil {
+		return groupEntry{}, err
+	}
+	for _, entry := range entries {
+		if entry.Name == name {
+			return entry, nil
+		}
+	}
+	return groupEntry{}, fmt.Errorf("Group %s not found in %s of the container", name, groupPath)
+}
+
+// resolveOwner resolves the user and group names against the databases in the container root into uid and gid.
+// Numeric values are used as they are, but they cannot be negative. If the group name is empty, the primary group of
+// the user will be used. If the user name is empty, -1 is returned as the uid.
+func resolveOwner(containerRoot string, userName string, groupName string) (int, int, error) {
+	uid, gid := -1, -1
+	if userName != "" {
+		parsedUID, err := strconv.Atoi(userName)
+		if err == nil {
+			if parsedUID < 0 {
+				return 0, 0, fmt.Errorf("Invalid negative uid %d", parsedUID)
+			}
+			uid = parsedUID
+		} else {
+			user, err := lookupUser(containerRoot, userName)
+			if err != nil {
+				return 0, 0, err
+			}
+			uid = user.UID
+			gid = user.GID
+		}
+	}
+	if groupName == "" {
+		if gid == -1 {
+			return 0, 0, fmt.Errorf("No group provided for numeric user %s", userName)
+		}
+		return uid, gid, nil
+	}
+	parsedGID, err := strconv.Atoi(groupName)
+	if err == nil {
+		if parsedGID < 0 {
+			return 0, 0, fmt.Errorf("Invalid negative gid %d", parsedGID)
+		}
+		return uid, parsedGID, nil
+	}
+	group, err := lookupGroup(containerRoot, groupName)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uid, group.GID, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+)
+
+const (
+	mockPasswd = `root:x:0:0:root:/root:/bin/sh
+# comment line
+
+postgres:x:70:70:PostgreSQL:/var/lib/postgresql:/bin/sh
+www-data:x:82:82:Linux User,,,:/home/www-data:/sbin/nologin
+broken:x:invalid:82::/:/sbin/nologin
+`
+	mockGroup = `root:x:0:root
+postgres:x:70:
+www-data:x:82:
+shared:x:3000:postgres,www-data
+`
+)
+
+func createMockRoot(t *testing.T) string {
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	etcDir := path.Join(rootDir, "etc")
+	err = os.MkdirAll(etcDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path.Join(etcDir, "passwd"), []byte(mockPasswd), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path.Join(etcDir, "group"), []byte(mockGroup), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rootDir
+}
+
+func Test_resolveOwner(t *testing.T) {
+	rootDir := createMockRoot(t)
+	type args struct {
+		userName  string
+		groupName string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		uid     int
+		gid     int
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{"only-user", args{"postgres", ""}, 70, 70, assert.NoError},
+		{"both", args{"www-data", "shared"}, 82, 3000, assert.NoError},
+		{"numeric-user", args{"2000", "shared"}, 2000, 3000, assert.NoError},
+		{"numeric-group", args{"postgres", "4000"}, 70, 4000, assert.NoError},
+		{"numeric-user-only", args{"2000", ""}, 0, 0, assert.Error},
+		{"negative-user", args{"-5", "shared"}, 0, 0, assert.Error},
+		{"negative-group", args{"postgres", "-5"}, 0, 0, assert.Error},
+		{"unknown-user", args{"nobody", ""}, 0, 0, assert.Error},
+		{"unknown-group", args{"postgres", "nogroup"}, 0, 0, assert.Error},
+		{"broken-entry", args{"broken", ""}, 0, 0, assert.Error},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uid, gid, err := resolveOwner(rootDir, tt.args.userName, tt.args.groupName)
+			if !tt.wantErr(t, err, fmt.Sprintf("resolveOwner(%v, %v)", tt.args.userName, tt.args.groupName)) {
+				return
+			}
+			assert.Equalf(t, tt.uid, uid, "resolveOwner(%v, %v)", tt.args.userName, tt.args.groupName)
+			assert.Equalf(t, tt.gid, gid, "resolveOwner(%v, %v)", tt.args.userName, tt.args.groupName)
+		})
+	}
+}
+
+func Test_lookupUserNotFollowingHostSymlink(t *testing.T) {
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(path.Join(rootDir, "etc"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Points to the host's passwd file, it should be resolved inside the container root instead
+	err = os.Symlink("/etc/passwd", path.Join(rootDir, "etc", "passwd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = lookupUser(rootDir, "root")
+	assert.Error(t, err)
+}
+
+func Test_lookupUserWithFIFO(t *testing.T) {
+	rootDir, err := os.MkdirTemp("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(path.Join(rootDir, "etc"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Opening a FIFO for reading blocks until there's a writer, it should be refused instead
+	err = syscall.Mkfifo(path.Join(rootDir, "etc", "passwd"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = lookupUser(rootDir, "root")
+	assert.Error(t, err)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"strings"
+)
+
+// The special xattr value for removing the xattr
+const XattrRemove string = "@remove"
+
+var xattrNamespaces = []string{"user.", "security.", "system."}
+
+// The xattrs which can only be set through the dedicated arguments, as they're validated or mapped there, keyed by the
+// name or the prefix of the names
+var reservedXattrs = map[string]string{
+	fcapsXattr:          annotationFCapsArg,
+	selinuxXattr:        annotationSELinuxLabelArg,
+	"system.posix_acl_": annotationACLArg + " or " + annotationDefaultACLArg,
+}
+
+// validateXattrName checks if the xattr name is in one of the namespaces and not reserved. The trusted namespace is
+// not allowed, as it's used by overlayfs for its metadata.
+func validateXattrName(name string) error {
+	for reserved, arg := range reservedXattrs {
+		if strings.HasPrefix(name, reserved) {
+			return fmt.Errorf("Xattr %q can only be set with the %s argument", name, arg)
+		}
+	}
+	for _, namespace := range xattrNamespaces {
+		if strings.HasPrefix(name, namespace) && len(name) > len(namespace) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Expected xattr name in one of the namespaces %s but got %q instead", strings.Join(xattrNamespaces, ", "), name)
+}
+
+// decodeXattrValue decodes the xattr value encoded like what setfattr(1) takes, a value prefixed with 0x is
+// hexadecimal, a value prefixed with 0s is base64, otherwise it's text
+func decodeXattrValue(value string) ([]byte, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(value, "0x") || strings.HasPrefix(value, "0X") {
+		data, err = hex.DecodeString(value[2:])
+	} else if strings.HasPrefix(value, "0s") || strings.HasPrefix(value, "0S") {
+		data, err = base64.StdEncoding.DecodeString(value[2:])
+	} else {
+		data = []byte(value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// setXattr sets the xattr of the file opened as O_PATH through its procfs magic link, which refers to the exact file,
+// or the symlink itself if it's a symlink
+func setXattr(target *os.File, name string, value []byte) error {
+	err := unix.Setxattr(fdPath(target), name, value, 0)
+	if err != nil {
+		return &os.PathError{Op: "setxattr", Path: target.Name(), Err: err}
+	}
+	return nil
+}
+
+// removeXattr removes the xattr of the file opened as O_PATH, it's not an error if the xattr doesn't exist
+func removeXattr(target *os.File, name string) error {
+	err := unix.Removexattr(fdPath(target), name)
+	if err != nil && !errors.Is(err, unix.ENODATA) {
+		return &os.PathError{Op: "removexattr", Path: target.Name(), Err: err}
+	}
+	return nil
+}
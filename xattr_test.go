@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_decodeXattrValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []byte
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{"text", "hello", []byte("hello"), assert.NoError},
+		{"empty", "", []byte{}, assert.NoError},
+		{"hex", "0x00ff10", []byte{0x00, 0xff, 0x10}, assert.NoError},
+		{"base64", "0saGVsbG8=", []byte("hello"), assert.NoError},
+		{"invalid-hex", "0xzz", nil, assert.Error},
+		{"invalid-base64", "0s!!", nil, assert.Error},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeXattrValue(tt.value)
+			if !tt.wantErr(t, err, fmt.Sprintf("decodeXattrValue(%v)", tt.value)) {
+				return
+			}
+			assert.Equalf(t, tt.want, got, "decodeXattrValue(%v)", tt.value)
+		})
+	}
+}
+
+func Test_validateXattrName(t *testing.T) {
+	tests := []struct {
+		name      string
+		xattrName string
+		wantErr   assert.ErrorAssertionFunc
+	}{
+		{"user", "user.checksum", assert.NoError},
+		{"security", "security.ima", assert.NoError},
+		{"trusted", "trusted.overlay.opaque", assert.Error},
+		{"fcaps", "security.capability", assert.Error},
+		{"selinux", "security.selinux", assert.Error},
+		{"acl", "system.posix_acl_access", assert.Error},
+		{"default-acl", "system.posix_acl_default", assert.Error},
+		{"no-namespace", "checksum", assert.Error},
+		{"empty-name", "user.", assert.Error},
+		{"unknown-namespace", "custom.checksum", assert.Error},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.wantErr(t, validateXattrName(tt.xattrName), fmt.Sprintf("validateXattrName(%v)", tt.xattrName))
+		})
+	}
+}